@@ -247,7 +247,7 @@ func (md *MetaData) unifyStruct(mapping interface{}, rv reflect.Value) error {
 				subv = indirect(subv.Field(i))
 			}
 			if isUnifiable(subv) {
-				md.decoded[md.context.add(key).String()] = true
+				md.decoded[md.context.Add(key).String()] = true
 				md.context = append(md.context, key)
 				if err := md.unify(datum, subv); err != nil {
 					return e("Type mismatch for '%s.%s': %s",
@@ -273,7 +273,7 @@ func (md *MetaData) unifyMap(mapping interface{}, rv reflect.Value) error {
 		rv.Set(reflect.MakeMap(rv.Type()))
 	}
 	for k, v := range tmap {
-		md.decoded[md.context.add(k).String()] = true
+		md.decoded[md.context.Add(k).String()] = true
 		md.context = append(md.context, k)
 
 		rvkey := indirect(reflect.New(rv.Type().Key()))
@@ -52,14 +52,33 @@ func (md *MetaData) Type(key ...string) string {
 }
 
 // Key is the type of any TOML key, including key groups. Use (MetaData).Keys
-// to get values of this type.
+// to get values of this type, or NewKey to construct one.
 type Key []string
 
+// NewKey returns a key made up of the pieces given, with the first element
+// being the top of the hierarchy.
+func NewKey(pieces ...string) Key {
+	k := make(Key, len(pieces))
+	copy(k, pieces)
+	return k
+}
+
+// String returns the pieces of the key joined by '.', as they are. Use Format
+// for a key that can be written in a TOML document.
 func (k Key) String() string {
 	return strings.Join(k, ".")
 }
 
-func (k Key) add(piece string) Key {
+// Format returns the key as it would be written in a TOML document: the
+// pieces joined by '.', with the pieces that can't be written bare quoted, as
+// FormatDottedKey does.
+func (k Key) Format() string {
+	return FormatDottedKey(k...)
+}
+
+// Add returns a new key with piece appended to it. The original key is not
+// modified.
+func (k Key) Add(piece string) Key {
 	newKey := make(Key, len(k)+1)
 	copy(newKey, k)
 	newKey[len(k)] = piece
@@ -1,6 +1,7 @@
 package toml
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"reflect"
@@ -349,6 +350,97 @@ func TestDecodeSizedInts(t *testing.T) {
 	}
 }
 
+func TestDecodeTagOptions(t *testing.T) {
+	type table struct {
+		Name  string `toml:"name,omitempty"`
+		Count int    `toml:",omitzero"`
+	}
+	var tab table
+	if _, err := Decode("name = \"x\"\ncount = 2", &tab); err != nil {
+		t.Fatal(err)
+	}
+	if want := (table{"x", 2}); tab != want {
+		t.Fatalf("Expected %#v but got %#v", want, tab)
+	}
+}
+
+func TestDecodeQuotedKeys(t *testing.T) {
+	input := `"a b" = 1
+"q\"uote" = 2
+"" = 3
+
+["t.u"]
+  "é" = 4
+  ["t.u".v]
+    x = 5
+
+[["rows@"]]
+  "x+y" = 6
+`
+	var got map[string]interface{}
+	if _, err := Decode(input, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"a b":     int64(1),
+		"q\"uote": int64(2),
+		"":        int64(3),
+		"t.u": map[string]interface{}{
+			"é": int64(4),
+			"v": map[string]interface{}{"x": int64(5)},
+		},
+		"rows@": []map[string]interface{}{{"x+y": int64(6)}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want\n%#v\nbut got\n%#v", want, got)
+	}
+
+	// Documents written by the encoder decode to the same keys.
+	var decoded map[string]interface{}
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(buf.String(), &decoded); err != nil {
+		t.Fatalf("decoding %q: %s", buf.String(), err)
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("round trip: want\n%#v\nbut got\n%#v", want, decoded)
+	}
+}
+
+func TestKey(t *testing.T) {
+	base := NewKey("servers", "alpha")
+	key := base.Add("ip")
+	if len(base) != 2 {
+		t.Fatalf("Add modified the original key: %v", base)
+	}
+	tests := []struct {
+		key        Key
+		wantString string
+		wantFormat string
+	}{
+		{NewKey(), "", ""},
+		{key, "servers.alpha.ip", "servers.alpha.ip"},
+		{NewKey("a.b", "c"), "a.b.c", `"a.b".c`},
+		{NewKey("", "with space", `q"uote`), `.with space.q"uote`,
+			`""."with space"."q\"uote"`},
+		{NewKey("a/b", "it's", "é", "a:b", "a+b@c"), "a/b.it's.é.a:b.a+b@c",
+			`"a/b"."it's"."é"."a:b"."a+b@c"`},
+		{NewKey("A_b-1", "2"), "A_b-1.2", "A_b-1.2"},
+	}
+	for _, test := range tests {
+		if got := test.key.String(); got != test.wantString {
+			t.Errorf("Key(%#v).String(): want %q, got %q",
+				[]string(test.key), test.wantString, got)
+		}
+		if got := test.key.Format(); got != test.wantFormat {
+			t.Errorf("Key(%#v).Format(): want %q, got %q",
+				[]string(test.key), test.wantFormat, got)
+		}
+	}
+}
+
 func TestUnmarshaler(t *testing.T) {
 
 	var tomlBlob = `
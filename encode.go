@@ -2,23 +2,97 @@ package toml
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
-type tomlEncodeError struct{ error }
+// tomlEncodeError is the panic value used to abort encoding. key is the key
+// being encoded when the error occurred, once it is known (keySet).
+type tomlEncodeError struct {
+	error
+	key    Key
+	keySet bool
+}
+
+// arrayNilElementError is the error for an array with a nil element at the
+// given index, since TOML arrays can't have holes.
+type arrayNilElementError struct{ index int }
+
+func (err arrayNilElementError) Error() string {
+	return fmt.Sprintf("can't encode array with nil element (at index %d)",
+		err.index)
+}
+
+// EncodeError is the type of the errors returned by Encode (and the Write*
+// methods) when a value can't be encoded, or when encoding is aborted.
+type EncodeError struct {
+	// Key is the key (or table) that was being encoded. It is empty for
+	// errors at the top level of the document.
+	Key Key
+
+	// Offset is the number of bytes of the document that were written
+	// before the error occurred (see Encoder.BytesWritten). Some of them may
+	// still be in the Encoder's buffer rather than in the io.Writer.
+	Offset int
+
+	// Err is the underlying error, such as ErrMaxDepth.
+	Err error
+}
+
+func (err *EncodeError) Error() string {
+	if len(err.Key) == 0 {
+		return fmt.Sprintf("%s (at byte %d)", err.Err, err.Offset)
+	}
+	return fmt.Sprintf("%s (key '%s', at byte %d)", err.Err,
+		err.Key.Format(), err.Offset)
+}
+
+// Unwrap returns the underlying error.
+func (err *EncodeError) Unwrap() error {
+	return err.Err
+}
+
+// EncodeErrors is the type of the error returned by Encode when the Encoder's
+// CollectErrors is set and one or more values couldn't be encoded. It holds
+// the errors in the order they occurred.
+type EncodeErrors []*EncodeError
+
+func (errs EncodeErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the errors, for errors.Is and errors.As.
+func (errs EncodeErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, err := range errs {
+		unwrapped[i] = err
+	}
+	return unwrapped
+}
 
 var (
 	errArrayMixedElementTypes = errors.New(
 		"can't encode array with mixed element types")
-	errArrayNilElement = errors.New(
-		"can't encode array with nil element")
+	errNilValue = errors.New(
+		"can't encode nil value")
 	errNonString = errors.New(
 		"can't encode a map with non-string key type")
 	errAnonNonStruct = errors.New(
@@ -27,22 +101,75 @@ var (
 		"TOML array element can't contain a table")
 	errNoKey = errors.New(
 		"top-level values must be a Go map or struct")
+	errCyclicReference = errors.New(
+		"can't encode a cyclic reference")
+	errUnsupportedType = errors.New(
+		"can't encode unsupported type")
+	errDuplicateKey = errors.New(
+		"can't encode duplicate key")
+	errInvalidIndent = errors.New(
+		"indentation must consist only of spaces and tabs")
+	errInvalidArrayStyle = errors.New(
+		"unknown array style")
+	errSchemaNewline = errors.New(
+		"schema comment can't contain a newline")
+	errInvalidSeparator = errors.New(
+		"key/value separator must be a single '=' surrounded by spaces " +
+			"and tabs")
+	errBlankKey = errors.New(
+		"can't encode an empty or blank key")
+	errSingleLinePrefix = errors.New(
+		"can't encode under a key prefix with SingleLine")
 	errAnything = errors.New("") // used in testing
 )
 
+var (
+	// ErrMaxDepth is returned by Encode (as the Err of an *EncodeError) when
+	// the value being encoded is nested more deeply than the Encoder's
+	// MaxDepth.
+	ErrMaxDepth = errors.New("toml: maximum encoding depth exceeded")
+
+	// ErrMaxBytes is returned by Encode (as the Err of an *EncodeError) when
+	// the encoded document would be larger than the Encoder's MaxBytes.
+	ErrMaxBytes = errors.New("toml: maximum encoded size exceeded")
+)
+
 type Modifier string
 
 const (
 	MOD_NONE                Modifier = ""
 	MOD_MULTILINE_STRING    Modifier = "multiline_string"
 	MOD_MULTILINE_RAWSTRING Modifier = "multiline_rawstring"
+
+	// MOD_EMBEDDED_TOML encodes the field's value as a separate TOML document
+	// and writes that document as a string.
+	MOD_EMBEDDED_TOML Modifier = "embedded_toml"
+
+	// MOD_RUNE encodes an int32 (rune) value as a string holding the
+	// character it is the code point of, e.g., "A" instead of 65.
+	MOD_RUNE Modifier = "rune"
+
+	// MOD_RUNES encodes a []rune (or an array of runes) as the string it
+	// spells, e.g., "abc" instead of [97, 98, 99]. Slices of []rune are
+	// written as arrays of strings, and a single rune as with MOD_RUNE.
+	MOD_RUNES Modifier = "runes"
 )
 
+// validmodifiers maps modifiers to the kind of value they apply to.
+// reflect.Invalid means the modifier applies to values of any kind.
 var validmodifiers = map[Modifier]reflect.Kind{
 	MOD_MULTILINE_STRING:    reflect.String,
 	MOD_MULTILINE_RAWSTRING: reflect.String,
+	MOD_EMBEDDED_TOML:       reflect.Invalid,
+	MOD_RUNE:                reflect.Int32,
+	MOD_RUNES:               reflect.Int32,
 }
 
+var multilineReplacer = strings.NewReplacer(
+	"\"", "\\\"",
+	"\\", "\\\\",
+)
+
 var quotedReplacer = strings.NewReplacer(
 	"\t", "\\t",
 	"\n", "\\n",
@@ -51,97 +178,1311 @@ var quotedReplacer = strings.NewReplacer(
 	"\\", "\\\\",
 )
 
+// StringEscaper escapes the strings written by an Encoder. Escape must return
+// s with every character that can't appear as is between double quotes in a
+// TOML basic string (at least '"', '\\' and control characters, including
+// newlines) replaced by a TOML escape sequence, such as \" or \u00E9, so that
+// the result can be written between double quotes and read back as s.
+//
+// For multi-line strings (see the multiline_string modifier), Escape is called
+// for every line separately, and the lines are joined with newlines.
+type StringEscaper interface {
+	Escape(s string) string
+}
+
+// DefaultStringEscaper is the StringEscaper used by an Encoder when its
+// StringEscaper is nil. It escapes '"', '\\', tabs, newlines and carriage
+// returns with the shortest escape sequences, and leaves everything else as
+// is.
+var DefaultStringEscaper StringEscaper = replacerEscaper{quotedReplacer}
+
+// replacerEscaper is a StringEscaper that escapes with a strings.Replacer.
+type replacerEscaper struct {
+	r *strings.Replacer
+}
+
+func (e replacerEscaper) Escape(s string) string {
+	return e.r.Replace(s)
+}
+
+var typeEncoders struct {
+	sync.RWMutex
+	m map[reflect.Type]func(interface{}) (string, error)
+}
+
+// RegisterEncoder registers fn as the encoder for values of type t, for all
+// Encoders. The string returned by fn is written as a TOML string. This allows
+// encoding types that can't be given a MarshalText method, and takes
+// precedence over the encoder's built in handling of t (including
+// TextMarshaler). Registering a nil fn removes the encoder for t.
+//
+// RegisterEncoder is safe to call concurrently with encoding.
+func RegisterEncoder(t reflect.Type, fn func(interface{}) (string, error)) {
+	typeEncoders.Lock()
+	defer typeEncoders.Unlock()
+	if fn == nil {
+		delete(typeEncoders.m, t)
+		return
+	}
+	if typeEncoders.m == nil {
+		typeEncoders.m = map[reflect.Type]func(interface{}) (string, error){}
+	}
+	typeEncoders.m[t] = fn
+}
+
+// registeredEncoder returns the function registered with RegisterEncoder for
+// the type of rv, or nil if there isn't one.
+func registeredEncoder(rv reflect.Value) func(interface{}) (string, error) {
+	typeEncoders.RLock()
+	defer typeEncoders.RUnlock()
+	return typeEncoders.m[rv.Type()]
+}
+
+// Spec is a version of the TOML specification that an Encoder's output must
+// conform to.
+type Spec int
+
+const (
+	// SpecDefault, the zero value, keeps the behavior from before Spec was
+	// added. It is TOML04, except that a `datetime` tag may have any layout
+	// that TOML05 allows.
+	SpecDefault Spec = iota
+
+	// TOML04 is TOML v0.4.0, which is understood by the most decoders
+	// (including the one in this package). A `datetime` tag must produce an
+	// offset datetime with a 'T', NaN and infinite floats are an error, and
+	// DottedKeys and AllowMixedArrays don't apply.
+	TOML04
+
+	// TOML05 is TOML v0.5.0. It adds `datetime` layouts for local
+	// datetimes, dates and times (and with a space instead of the 'T'), the
+	// floats nan, inf and -inf, and DottedKeys.
+	TOML05
+
+	// TOML10 is TOML v1.0.0. It allows everything TOML05 does, and adds
+	// AllowMixedArrays.
+	TOML10
+)
+
+// ArrayStyle is the layout of arrays written by an Encoder.
+type ArrayStyle int
+
+const (
+	// ArrayCompact writes arrays on a single line: [1, 2, 3].
+	ArrayCompact ArrayStyle = iota
+
+	// ArrayExpanded writes every element of an array on its own line,
+	// indented one level deeper than the key (or enclosing array), with the
+	// closing bracket on its own line.
+	ArrayExpanded
+
+	// ArrayAuto writes an array on a single line if it fits within
+	// ArrayWidth, and expanded otherwise. Nested arrays are laid out
+	// independently.
+	ArrayAuto
+)
+
+// KeyCase is the case that an Encoder writes keys in.
+type KeyCase int
+
+const (
+	// CaseNone writes keys as they are.
+	CaseNone KeyCase = iota
+
+	// CaseLower writes keys in lower case.
+	CaseLower
+
+	// CaseUpper writes keys in upper case.
+	CaseUpper
+)
+
+// apply returns s in case c.
+func (c KeyCase) apply(s string) string {
+	switch c {
+	case CaseLower:
+		return strings.ToLower(s)
+	case CaseUpper:
+		return strings.ToUpper(s)
+	}
+	return s
+}
+
+// EncodeStats describes the structure of the output written by an Encoder.
+type EncodeStats struct {
+	// Tables is the number of table headers ([table]) written. The top
+	// level table, which has no header, isn't counted.
+	Tables int
+
+	// ArrayTables is the number of array of tables headers ([[table]])
+	// written, which is one for every element of an array of tables.
+	ArrayTables int
+
+	// Keys is the number of key = value pairs written, outside of inline
+	// tables. Inline tables and arrays are counted as a single key.
+	Keys int
+
+	// Bytes is the number of bytes written, as returned by BytesWritten.
+	Bytes int
+}
+
 // Encoder controls the encoding of Go values to a TOML document to some
 // io.Writer.
 //
 // The indentation level can be controlled with the Indent field.
 type Encoder struct {
-	// A single indentation level. By default it is two spaces.
+	// A single indentation level. By default it is two spaces. It may only
+	// contain spaces and tabs, so "\t" gives tab-indented output. Use
+	// SetIndent to change it with validation; Encode returns an error if it
+	// has been set to anything else.
 	Indent string
 
+	// BaseIndent is a number of indentation levels added to every indented
+	// line, so that the output can be spliced into a larger document under
+	// headers written by something else. The lines of multi-line strings
+	// aren't indented, since that would change their value. By default
+	// (zero) top-level keys and tables aren't indented.
+	BaseIndent int
+
+	// KeyValueSeparator is written between the key and the value of every
+	// key/value pair, including those in inline tables. By default (empty)
+	// it is " = ". It must be a single "=", optionally surrounded by spaces
+	// and tabs, e.g., "=" for `key=value`; Encode returns an error if it
+	// isn't. It is ignored when Canonical is set.
+	KeyValueSeparator string
+
+	// Spec is the version of TOML that the output conforms to. Features of
+	// later versions are not used, and values that need them return an
+	// error. By default (SpecDefault) it is TOML04, which is the most widely
+	// supported, but with the `datetime` layouts of TOML05.
+	Spec Spec
+
+	// ArrayStyle controls how arrays (that aren't arrays of tables) are laid
+	// out. By default (ArrayCompact) they are written on a single line.
+	ArrayStyle ArrayStyle
+
+	// ArrayWidth is the line width used by ArrayAuto. By default (zero) it
+	// is 80.
+	ArrayWidth int
+
+	// TrailingComma causes a comma to be written after the last element of
+	// arrays written in expanded form (see ArrayExpanded), so that adding an
+	// element later only changes a single line. Arrays written on a single
+	// line never have a trailing comma.
+	TrailingComma bool
+
+	// SingleLine writes documents in their most compact form, e.g., to pass
+	// a small configuration in an environment variable: every key = value
+	// pair at the top level is written on its own line (TOML doesn't allow
+	// more than one per line), with every table written as an inline table,
+	// arrays of tables as arrays of inline tables, and all arrays on a single
+	// line. No table headers, blank lines or indentation are written (other
+	// than BaseIndent), so a document without tables is a single line per
+	// key. Since inline tables can't span lines, InlineTableWidth, ArrayStyle
+	// and multi-line string modifiers are ignored, as are comments. The
+	// string option, `datetime` tag and other modifiers of top-level struct
+	// fields apply as usual, but those of fields in the inline tables don't,
+	// as in any inline table. EncodeUnder returns an error for it with a
+	// non-empty prefix, since the prefix's header can't be written.
+	//
+	// N.B. The decoder in this package doesn't read inline tables.
+	SingleLine bool
+
+	// KeyCase changes the case of every key written, both the names of
+	// struct fields (including names given by tags) and map keys, e.g.,
+	// CaseLower writes a field Name as `name`. Keys are quoted if needed
+	// after the case is changed, and map keys are sorted by their new case.
+	// The keys given to FieldFilter, RedactKeys, TopLevelKeyOrder and
+	// OnKeyValue are those before the case is changed. Two keys in a table
+	// that only differ by case (such as fields A and a) would be written as
+	// the same key, so they're an error (errDuplicateKey). By default
+	// (CaseNone) keys are written as they are.
+	KeyCase KeyCase
+
+	// Canonical locks down the formatting of the output so that encoding the
+	// same value always produces the same bytes, which keeps diffs of
+	// generated documents minimal. In canonical form:
+	//
+	//   - map keys are sorted, and keys are written before sub-tables;
+	//   - indentation is always two spaces per level (Indent is ignored);
+	//   - arrays are always written on a single line (ArrayStyle is
+	//     ignored);
+	//   - floats are written in decimal notation (never in scientific
+	//     notation) with the fewest digits that represent the value exactly;
+	//   - a single blank line is written before every top-level table and
+	//     every array of tables element, and nowhere else.
+	//
+	// The choices above are also the defaults, but the canonical form is
+	// guaranteed not to change in future versions.
+	Canonical bool
+
+	// EnumAsString causes values implementing fmt.Stringer (that aren't
+	// already TextMarshalers) to be encoded as the quoted result of their
+	// String method instead of by their underlying kind. This is useful for
+	// enum-like types such as `type Status int`. It is off by default since
+	// it changes the encoding of every Stringer.
+	EnumAsString bool
+
+	// ErrorAsString causes values implementing error (that aren't already
+	// TextMarshalers) to be encoded as the quoted result of their Error
+	// method, e.g., for an error field of a struct. It takes precedence over
+	// EnumAsString. It is off by default since error types may also be
+	// structs that should be encoded as tables. Nil errors aren't written.
+	ErrorAsString bool
+
+	// OmitEmptyText causes struct fields with the omitempty option whose
+	// value implements TextMarshaler to be omitted when MarshalText returns
+	// empty text, e.g., for an ID type whose zero value is written as "". It
+	// is off by default since MarshalText has to be called to find out (the
+	// text is reused to write the value, so it is only called once).
+	OmitEmptyText bool
+
+	// TimeZone, when not nil, is the location that datetimes are converted
+	// to before they're written, with the offset of that location (or "Z"
+	// for UTC), e.g., "2006-01-02T22:04:05+07:00". It applies to datetimes
+	// with a `datetime` layout too. By default, datetimes are written in UTC.
+	//
+	// N.B. The decoder in this package only reads datetimes in UTC.
+	TimeZone *time.Location
+
+	// StringEscaper, when not nil, escapes the strings written instead of
+	// DefaultStringEscaper, e.g., to escape all non-ASCII characters. It
+	// applies to the lines of multi-line strings too, which are otherwise
+	// only escaped as needed (tabs and carriage returns are kept as is).
+	StringEscaper StringEscaper
+
+	// AlignValues causes the keys of the values written in a table (but not
+	// those of its sub-tables, which are aligned on their own) to be padded
+	// with spaces so that their = signs line up, e.g.:
+	//
+	//   name    = "toml"
+	//   version = 1
+	//
+	// It doesn't apply to inline tables, and is ignored when Canonical is
+	// set.
+	AlignValues bool
+
+	// BoolAsString, when not nil, causes booleans (including booleans in
+	// arrays) to be encoded as quoted strings: BoolAsString[0] for true and
+	// BoolAsString[1] for false, e.g., &[2]string{"on", "off"}.
+	//
+	// N.B. The output is a TOML string, NOT a TOML boolean, so decoding it
+	// back into a bool will fail unless the decoding side does the reverse
+	// mapping itself (e.g., with a TextUnmarshaler).
+	BoolAsString *[2]string
+
+	// DetectDuplicateKeys causes Encode to return an error when two struct
+	// fields would be written with the same key in the same table, instead
+	// of writing both (which produces an invalid document). This can happen
+	// when embedded structs have fields with the same name, or when a `toml`
+	// tag gives a field the name of another field. Without it, fields that
+	// are tables with the same key are still written as a single table, with
+	// the keys of all of them.
+	DetectDuplicateKeys bool
+
+	// FoldSingleTableArrays causes an array of tables with exactly one
+	// element to be encoded as a plain table ([table] instead of [[table]]).
+	// Arrays of tables with any other number of elements are unaffected.
+	//
+	// Since this changes the type of the value in the document, decoding it
+	// back into a slice will fail.
+	FoldSingleTableArrays bool
+
+	// IgnoreTextMarshaler causes values that implement TextMarshaler to be
+	// encoded by their kind (e.g., structs as tables), as if they didn't,
+	// instead of as the quoted result of their MarshalText method. This is
+	// useful for types whose MarshalText is meant for something else. It
+	// doesn't apply to datetimes (time.Time is always written as a TOML
+	// datetime), to types with an encoder registered for them, or to map
+	// keys.
+	IgnoreTextMarshaler bool
+
+	// StrictKeys causes keys that are empty or only whitespace, which are
+	// usually the result of a bug (e.g., in a map built from user input), to
+	// return an error. By default they're written quoted, e.g., "" = 1, like
+	// other keys that can't be written bare.
+	StrictKeys bool
+
+	// StrictModifiers causes a struct field's `modifier` tag to return an
+	// error if the modifier is unknown or doesn't apply to the field's type
+	// (e.g., `modifier:"multiline_string"` on an int field), instead of
+	// being ignored. The error gives the field's key.
+	StrictModifiers bool
+
+	// ExplicitSign causes integers and floats that aren't negative to be
+	// written with a plus sign, e.g., +42 and +1.5, so that they line up
+	// with negative numbers. Zero is written as +0 (or +0.0), and infinity as
+	// +inf; NaN is written as nan. It is ignored when Canonical is set.
+	//
+	// N.B. The decoder in this package doesn't read numbers with a plus sign.
+	ExplicitSign bool
+
+	// ComplexAsString causes complex numbers, which have no TOML
+	// representation, to be encoded as quoted strings such as "(3+4i)".
+	// Without it, encoding a complex number returns an error.
+	ComplexAsString bool
+
+	// SkipUnsupported causes struct fields and map values that have no TOML
+	// representation to be left out, like unexported fields, instead of
+	// returning an error: channels, functions, uintptrs, unsafe pointers and
+	// complex numbers (unless ComplexAsString is set), as well as structs
+	// with only unexported fields, such as sync.Mutex, which would otherwise
+	// be written as empty tables. This is useful for structs that mix
+	// configuration with runtime state. Arrays of such values still return
+	// an error.
+	SkipUnsupported bool
+
+	// CollectErrors causes Encode to carry on after a value that can't be
+	// encoded, leaving it out, and to return all such errors at once as an
+	// EncodeErrors, so that every problem in a struct can be fixed in one
+	// go. The error is recorded for the innermost key being encoded, and
+	// the rest of that key's value is left out. Exceeding MaxDepth or
+	// MaxBytes, cancellation and errors writing to the io.Writer still stop
+	// encoding, and are returned on their own (as an *EncodeError) even if
+	// other errors were collected before them. When an error is returned,
+	// the output is incomplete and shouldn't be used.
+	CollectErrors bool
+
+	// UseJSONTagFallback causes the `json` tag of a struct field to be used
+	// for its name and its "-", omitempty and string options when the field
+	// has no `toml` tag. A `toml` tag always takes precedence.
+	UseJSONTagFallback bool
+
+	// InlineTableWidth is the maximum length of a line with an inline
+	// table, for struct fields with the inline option (`toml:",inline"`).
+	// Tables that would make the line longer are promoted to standard
+	// tables ([table]), since TOML doesn't allow inline tables to span
+	// multiple lines. By default (zero) it is 80.
+	InlineTableWidth int
+
+	// FieldFilter, when not nil, is called with the full key and the value of
+	// every struct field and map entry before it is written, and with the key
+	// and value of every element of an array of tables. Returning false
+	// leaves out the key, or the array element. Leaving out a table leaves
+	// out everything in it. This can be used to remove secrets (such as
+	// passwords) from the output without changing the value being encoded.
+	FieldFilter func(key Key, v reflect.Value) bool
+
+	// OnKeyValue, when not nil, is called after every key = value pair is
+	// written (including arrays and inline tables, but not table headers),
+	// with the full key, the TOML type of the value as written (as returned
+	// by MetaData.Type, e.g., "Integer", or "String" for a value written as
+	// a string) and the value exactly as written, e.g., `"a\tb"`. It can be
+	// used to log or collect what is written, but not to change it. It isn't
+	// called for the keys of documents written by the embedded_toml
+	// modifier.
+	OnKeyValue func(key Key, tomlType string, rendered string)
+
+	// RedactKeys maps full keys, as returned by Key.String (e.g.,
+	// "database.password"), to a placeholder such as "***". The value of a
+	// matching key is replaced by its placeholder, which is always written
+	// as a string, whatever the type of the value. Only values written as
+	// key = value are redacted (including arrays, but not inline tables);
+	// tables are written as usual.
+	RedactKeys map[string]string
+
+	// EmitParentTables causes a header to be written for every table that
+	// contains another table before the header of the inner table, if it
+	// hasn't been written already, e.g., [a] before [a.b]. Encode already
+	// writes all of these headers, except when the parent is left out (such
+	// as by FieldFilter); the Write* methods only write the headers they're
+	// asked to write. Headers written by the last call to Encode, or by the
+	// Write* methods since then, are never written again.
+	EmitParentTables bool
+
+	// AllowMixedArrays allows arrays whose elements have different types,
+	// such as [1, "two", true] from a []interface{}, which are valid since
+	// TOML 1.0. It only applies when Spec is TOML10; otherwise Encode returns
+	// an error for them, as it does by default. Tables still can't be mixed
+	// with other values in an array.
+	AllowMixedArrays bool
+
+	// DottedKeys causes a table with a single key, whose value is a string,
+	// number, boolean or datetime, to be written as a dotted key in its
+	// parent table instead of under its own header, e.g., `server.host = "x"`
+	// instead of [server] followed by `host = "x"`. Struct tables are only
+	// written this way if none of their fields have tags that change how
+	// they're written (such as a modifier, datetime layout or comment).
+	// Dotted keys are valid since TOML 0.5, so DottedKeys only applies when
+	// Spec is TOML05 or later.
+	//
+	// N.B. The decoder in this package doesn't read dotted keys.
+	DottedKeys bool
+
+	// NullRepresentation is the string that Null values are written as,
+	// e.g., "null" for `key = "null"`. By default it is the empty string.
+	NullRepresentation string
+
+	// EmitEmptyContainers causes nil slices and maps to be written as empty
+	// arrays (key = []) and empty tables ([key] with nothing in it), like
+	// empty slices and maps that aren't nil. By default, nil slices and maps
+	// aren't written at all, since they're usually unset rather than empty;
+	// empty ones are always written. This applies to struct fields and map
+	// values, but not to array elements. Fields with omitempty or omitzero
+	// are omitted either way.
+	EmitEmptyContainers bool
+
+	// EmitNilPointersAsZero causes nil pointers to scalar types (such as a
+	// nil *int, *string, *bool or *time.Time) to be written as the zero
+	// value of the type they point to, e.g., `count = 0`. By default, like
+	// other nil values, they aren't written at all. Like
+	// EmitEmptyContainers, this applies to struct fields and map values but
+	// not to array elements, and fields with omitempty are omitted either
+	// way. Nil pointers to tables and arrays aren't affected.
+	EmitNilPointersAsZero bool
+
+	// SkipNilArrayElements causes nil elements (such as nil pointers in a
+	// []*int) to be left out of arrays. Since TOML arrays can't have holes,
+	// by default Encode returns an error for them, which gives the index of
+	// the nil element. This applies to arrays of tables as well.
+	SkipNilArrayElements bool
+
+	// TopLevelKeyOrder is the order in which the keys of a map given to
+	// Encode are written, e.g., to match a reference document. Keys that
+	// aren't in it are written after those that are, in alphabetical order.
+	// Keys are still written before tables, so the order applies to each
+	// separately. It doesn't apply to nested maps, or when Canonical is set.
+	TopLevelKeyOrder []string
+
+	// FinalNewline causes a document to end with exactly one newline. When it
+	// is false, the document ends without one. NewEncoder sets it to true.
+	// Newlines left out at the end of a document are written before the
+	// output of the next call to Encode (or a Write* method), so that
+	// documents written one after another are still valid TOML.
+	FinalNewline bool
+
+	// Header is written as a comment before any encoded output, with each
+	// line (split on "\n") prefixed by "# ". It is separated from the first
+	// entry by a single blank line. Nothing is written when it is empty.
+	Header string
+
+	// SchemaComment is the location of a JSON schema for the document, such
+	// as "https://example.com/schema.json". It is written as a
+	// "#:schema <location>" comment on the first line of the document,
+	// before the Header, which editors use to validate the document. Like
+	// the Header, it is separated from the first entry by a blank line. It
+	// can't contain a newline.
+	SchemaComment string
+
+	// MaxDepth limits how deeply nested the value given to Encode may be.
+	// Every table, pointer and interface counts as one level. When it is
+	// exceeded, Encode returns an error wrapping ErrMaxDepth. By default
+	// (zero) there is no limit.
+	MaxDepth int
+
+	// MaxBytes limits the size of a single encoded document. When writing
+	// the next piece of output would exceed it, Encode stops and returns an
+	// error wrapping ErrMaxBytes without writing that piece. By default
+	// (zero) there is no limit.
+	MaxBytes int
+
+	// MaxArrayTableElements limits the number of elements of an array of
+	// tables. Encoding a longer array of tables returns an error, which
+	// gives its key and length, before any of its tables is written. By
+	// default (zero) there is no limit.
+	MaxArrayTableElements int
+
+	// FlushInterval causes Encode to flush its buffered output to the
+	// io.Writer every FlushInterval top-level tables (counting every
+	// element of a top-level array of tables), right before the header of
+	// the next one, instead of only once the whole document has been
+	// written. This lets the reader of a large document see it as it is
+	// written. An error flushing stops encoding. By default (zero) output
+	// is only flushed at the end.
+	FlushInterval int
+
 	// hasWritten is whether we have written any output to w yet.
 	hasWritten bool
 	w          *bufio.Writer
 
+	// flushTables is the number of top-level tables written since output
+	// was last flushed, for FlushInterval.
+	flushTables int
+
+	// depth is the current nesting level and written is the number of bytes
+	// written by the current call to Encode. They are used to enforce
+	// MaxDepth and MaxBytes.
+	depth   int
+	written int
+
+	// newlines is the number of newlines at the end of the output that
+	// haven't been written yet. They are held back by wf until more output
+	// follows, or until the end of the document for FinalNewline.
+	newlines int
+
+	// stats holds the counts returned by Stats, except for the number of
+	// bytes (which is written).
+	stats EncodeStats
+
+	// visited holds the pointers, maps and slices on the path from the top
+	// level value to the value currently being encoded. It is used to detect
+	// cycles.
+	visited map[visitedRef]bool
+
+	// substitutes holds the values returned by TOMLValue methods, decoded
+	// from json.RawMessages and taken from sync.Maps during the current call
+	// to Encode, by the values they were found for (see valueID), so that
+	// each is only computed once.
+	substitutes map[interface{}]substitute
+
+	// collecting is set during a call to Encode with CollectErrors, and
+	// collected holds the errors recorded so far. writeErr is the error
+	// returned by w, which always stops encoding.
+	collecting bool
+	collected  EncodeErrors
+	writeErr   error
+
 	// modifiers contains a map of struct field keys with detected modifiers
 	modifier Modifier
+
+	// timeLayout is the layout given by the `datetime` tag of the struct
+	// field being encoded, if any. It applies to the field's value and the
+	// elements of arrays, but not to the contents of tables.
+	timeLayout string
+
+	// elementKey is the key of the value being written by keyEqElement. It
+	// is only used for error messages.
+	elementKey Key
+
+	// arrayDepth is the nesting level of the array being written in expanded
+	// form.
+	arrayDepth int
+
+	// asString is set by the string option of the struct field being
+	// encoded. It causes a number or boolean value to be written as a
+	// string, but doesn't apply to arrays or the contents of tables.
+	asString bool
+
+	// text is the result of MarshalText for the value of the struct field
+	// being encoded, when OmitEmptyText has already called it. It is used
+	// (and cleared) when the value is written.
+	text []byte
+
+	// dotted is the number of pieces at the end of the key written by
+	// keyEqElement, besides the last one, that are written as a dotted key
+	// for DottedKeys (rather than being part of the table's key).
+	dotted int
+
+	// aligning is set while the values of a table are written for
+	// AlignValues, and marks holds the position and width of every key
+	// written since, so that the keys can be padded.
+	aligning   bool
+	alignStart int
+	marks      []alignMark
+
+	// capture holds the value being written by keyEqElement, for OnKeyValue.
+	capture *bytes.Buffer
+
+	// comment is the `comment` tag of the struct field being encoded. It is
+	// written (and cleared) right before the field's key or table header.
+	comment string
+
+	// headers holds the headers written so far, for EmitParentTables.
+	headers map[string]bool
+
+	// noFastPath disables ePrimitiveMap, so that tests and benchmarks can
+	// compare it with eMap.
+	noFastPath bool
+
+	// encoders holds the type encoders registered with RegisterTypeEncoder
+	// and RegisterRawTypeEncoder.
+	encoders map[reflect.Type]typeEncoder
+
+	// ctx is checked for cancellation while encoding. It is only set for
+	// the duration of an EncodeContext call.
+	ctx interface {
+		Err() error
+	}
 }
 
 // NewEncoder returns a TOML encoder that encodes Go values to the io.Writer
 // given. By default, a single indentation level is 2 spaces.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{
-		w:        bufio.NewWriter(w),
-		Indent:   "  ",
-		modifier: MOD_NONE,
+		w:            bufio.NewWriter(w),
+		Indent:       "  ",
+		modifier:     MOD_NONE,
+		FinalNewline: true,
+	}
+}
+
+// MarshalTo writes the TOML encoding of v to w, using an Encoder with the
+// default options. The output is flushed before MarshalTo returns, and if v
+// can't be encoded the error is the same as that of Encode.
+func MarshalTo(w io.Writer, v interface{}) error {
+	return NewEncoder(w).Encode(v)
+}
+
+// FormatValue returns the TOML representation of a single string, number,
+// boolean or datetime (including values written as strings, such as
+// TextMarshalers), exactly as Encode would write it after `key = `, using
+// the default options, e.g., "\"a\\tb\"" for "a\tb" and "1.0" for 1.0.
+// Tables and arrays return an error, as do nil values.
+func FormatValue(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	err := enc.safe(func() {
+		rv := valueOf(v)
+		switch typ := enc.tomlTypeOfGo(rv); {
+		case typ == nil:
+			encPanic(errNilValue)
+		case typeIsHash(typ), typeEqual(typ, tomlArray):
+			encPanic(e("can't format %s as a single value", rv.Type()))
+		}
+		enc.eElement(rv)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := enc.w.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// FormatKey returns segment as a single TOML key: bare if it is made up only
+// of ASCII letters, digits, '_' and '-', and quoted otherwise (including when
+// it is empty), e.g., "a-b" for "a-b" and "\"a.b\"" for "a.b".
+func FormatKey(segment string) string {
+	if isBareKey(segment) {
+		return segment
+	}
+	return "\"" + quotedReplacer.Replace(segment) + "\""
+}
+
+// FormatDottedKey returns the segments given as a single dotted TOML key,
+// quoting every segment as FormatKey does, e.g., "a.\"b c\"" for "a" and
+// "b c".
+func FormatDottedKey(parts ...string) string {
+	pieces := make([]string, len(parts))
+	for i, part := range parts {
+		pieces[i] = FormatKey(part)
+	}
+	return strings.Join(pieces, ".")
+}
+
+// isBareKey returns whether s can be written as a bare key, per the TOML
+// spec.
+func isBareKey(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Reset discards any unflushed output and any state left over from previous
+// calls to Encode, and makes the encoder write to w. Configuration such as
+// Indent is preserved, so an Encoder can be reused (e.g., with a sync.Pool)
+// instead of calling NewEncoder for every document.
+func (enc *Encoder) Reset(w io.Writer) {
+	enc.w.Reset(w)
+	enc.resetOutput()
+	enc.depth = 0
+	enc.visited = nil
+	enc.substitutes = nil
+	enc.ctx = nil
+}
+
+// Clone returns a new Encoder that writes to w, with the same configuration
+// as enc (including the type encoders registered) but none of its state, so
+// that an Encoder can be used as a template for others. Options that are
+// maps, slices, functions or interfaces, such as RedactKeys and FieldFilter,
+// are shared with enc rather than copied, so they shouldn't be modified
+// while either Encoder is in use. Registering type encoders on the clone
+// doesn't affect enc, and vice versa.
+func (enc *Encoder) Clone(w io.Writer) *Encoder {
+	clone := *enc
+	clone.w = bufio.NewWriter(w)
+	clone.resetOutput()
+	clone.depth = 0
+	clone.visited = nil
+	clone.substitutes = nil
+	clone.ctx = nil
+	if enc.encoders != nil {
+		clone.encoders = make(map[reflect.Type]typeEncoder, len(enc.encoders))
+		for t, te := range enc.encoders {
+			clone.encoders[t] = te
+		}
+	}
+	return &clone
+}
+
+// resetOutput clears the state that describes what has been written so far.
+func (enc *Encoder) resetOutput() {
+	enc.hasWritten = false
+	enc.modifier = MOD_NONE
+	enc.timeLayout = ""
+	enc.comment = ""
+	enc.elementKey = nil
+	enc.arrayDepth = 0
+	enc.asString = false
+	enc.text = nil
+	enc.dotted = 0
+	enc.aligning = false
+	enc.alignStart = 0
+	enc.marks = nil
+	enc.capture = nil
+	enc.collecting = false
+	enc.collected = nil
+	enc.written = 0
+	enc.newlines = 0
+	enc.stats = EncodeStats{}
+	enc.headers = nil
+}
+
+// SetArrayStyle sets the layout of arrays. An error is returned (and the
+// style is left unchanged) if style is not one of the ArrayStyle constants.
+func (enc *Encoder) SetArrayStyle(style ArrayStyle) error {
+	switch style {
+	case ArrayCompact, ArrayExpanded, ArrayAuto:
+		enc.ArrayStyle = style
+		return nil
+	}
+	return errInvalidArrayStyle
+}
+
+// SetIndent sets a single indentation level. An error is returned (and the
+// indentation is left unchanged) if indent contains anything other than
+// spaces and tabs.
+func (enc *Encoder) SetIndent(indent string) error {
+	if !isValidIndent(indent) {
+		return errInvalidIndent
+	}
+	enc.Indent = indent
+	return nil
+}
+
+// typeEncoder is a function registered to encode values of a particular type.
+// The bytes it returns are written as a TOML string, or verbatim if raw is
+// set.
+type typeEncoder struct {
+	fn  func(v interface{}) ([]byte, error)
+	raw bool
+}
+
+// RegisterTypeEncoder registers fn as the encoder for values of type t for
+// this Encoder only. The bytes returned by fn are written as a TOML string.
+// It takes precedence over the encoder's built in handling of t (including
+// TextMarshaler) and over encoders registered with RegisterEncoder.
+//
+// If no encoder is registered for t itself, one registered for *t is used
+// for addressable values of t, and one registered for the element type of t
+// is used when t is a pointer. Registering a nil fn removes the encoder for t.
+//
+// For the purpose of checking that arrays are homogeneous, values of t are
+// considered to be strings.
+func (enc *Encoder) RegisterTypeEncoder(
+	t reflect.Type, fn func(v interface{}) ([]byte, error),
+) {
+	enc.registerTypeEncoder(t, typeEncoder{fn, false})
+}
+
+// RegisterRawTypeEncoder is just like RegisterTypeEncoder, except the bytes
+// returned by fn are written verbatim as the value (e.g., a number returned
+// by a decimal library). It is up to fn to return a valid TOML value.
+func (enc *Encoder) RegisterRawTypeEncoder(
+	t reflect.Type, fn func(v interface{}) ([]byte, error),
+) {
+	enc.registerTypeEncoder(t, typeEncoder{fn, true})
+}
+
+func (enc *Encoder) registerTypeEncoder(t reflect.Type, te typeEncoder) {
+	if te.fn == nil {
+		delete(enc.encoders, t)
+		return
+	}
+	if enc.encoders == nil {
+		enc.encoders = map[reflect.Type]typeEncoder{}
+	}
+	enc.encoders[t] = te
+}
+
+// typeEncoderFor returns the type encoder that should be used for rv along
+// with the value that should be given to it. Encoders registered with this
+// Encoder come before those registered with RegisterEncoder.
+func (enc *Encoder) typeEncoderFor(
+	rv reflect.Value,
+) (typeEncoder, reflect.Value, bool) {
+	if len(enc.encoders) > 0 {
+		t := rv.Type()
+		if te, ok := enc.encoders[t]; ok {
+			return te, rv, true
+		}
+		if rv.CanAddr() {
+			if te, ok := enc.encoders[reflect.PtrTo(t)]; ok {
+				return te, rv.Addr(), true
+			}
+		}
+		if t.Kind() == reflect.Ptr && !rv.IsNil() {
+			if te, ok := enc.encoders[t.Elem()]; ok {
+				return te, rv.Elem(), true
+			}
+		}
+	}
+	if fn := registeredEncoder(rv); fn != nil {
+		te := typeEncoder{fn: func(v interface{}) ([]byte, error) {
+			s, err := fn(v)
+			return []byte(s), err
+		}}
+		return te, rv, true
 	}
+	return typeEncoder{}, rv, false
 }
 
 // Encode writes a TOML representation of the Go value to the underlying
 // io.Writer. If the value given cannot be encoded to a valid TOML document,
 // then an error is returned.
 //
+// The value is usually a map or struct, or a pointer to one. A reflect.Value
+// (or *reflect.Value) is encoded as the value it holds.
+//
 // The mapping between Go values and TOML values should be precisely the same
 // as for the Decode* functions. Similarly, the TextMarshaler interface is
 // supported by encoding the resulting bytes as strings. (If you want to write
 // arbitrary binary data then you will need to use something like base64 since
-// TOML does not have any binary types.)
+// TOML does not have any binary types.) url.URL values are encoded as strings
+// too, and RegisterEncoder can be used to encode other types as strings.
+// json.Number values (from a json.Decoder with UseNumber) are encoded as
+// floats if they have a fraction or an exponent, and as integers otherwise;
+// an empty json.Number is encoded as 0. Values that implement TOMLValuer are
+// encoded as the value returned by their TOMLValue method instead. A sync.Map
+// is encoded like a map with the same keys (which must be strings) and
+// values, as they are when it's first reached.
 //
 // When encoding TOML hashes (i.e., Go maps or structs), keys without any
 // sub-hashes are encoded first.
 //
+// A struct field tagged with the `omitempty` option (e.g., `toml:",omitempty"`)
+// is not written if it is false, 0, "", nil or an empty array, slice or map.
+// If its type implements IsZeroer (as time.Time does), it is not written when
+// IsZero returns true instead. With the Encoder's OmitEmptyText, it is also
+// not written if it implements TextMarshaler and MarshalText returns empty
+// text. The `omitzero` option only omits a field if it is the zero value of
+// its type, so empty but non-nil slices and maps are still written. When
+// both are given, the field is omitted if either applies.
+//
+// A number or boolean field with the `string` option is written as a string,
+// e.g., `port = "8080"`, like with the option of the same name in
+// encoding/json. The option has no effect on other fields, including arrays
+// and tables. N.B. Decoding such a string back into a number or boolean
+// fails unless the decoding side does the conversion itself.
+//
+// A table (map or struct) field with the `inline` option is written as an
+// inline table, e.g., `point = { x = 1, y = 2 }`, along with all the tables
+// in it. If that line would be longer than the Encoder's InlineTableWidth, the
+// field is written as a standard table instead.
+//
+// The fields of an embedded struct, or of a struct that an embedded pointer
+// points to, are written as if they were fields of the embedding struct. If an
+// embedded pointer is nil, none of its fields are written. An embedded struct
+// whose tag gives it a name, e.g., `toml:"meta"`, is written like any other
+// field instead (usually as a table).
+//
+// Pointers and interfaces are written as the value they hold. A nil pointer
+// or interface, in a struct field or a map value, isn't written at all (see
+// the Encoder's EmitNilPointersAsZero and EmitEmptyContainers to write some
+// of them anyway), so a nil *int field and a missing one look the same in
+// the document; use a non-pointer field to always write a value.
+//
+// A struct field's `comment` tag is written as a comment (one "# " line per
+// line of the tag) right before its key or table header. A table (map or
+// struct) field with a comment is never omitted entirely: if it is nil, or
+// would be omitted by omitempty or omitzero, its comment and table header
+// are still written as a placeholder, e.g., "# comment\n[section]".
+//
+// Datetimes are written in UTC as "2006-01-02T15:04:05Z" by default, with
+// fractional seconds (without trailing zeros) when they are non-zero. The
+// layout used for a time.Time struct field (or the elements of an array field)
+// can be changed with the `datetime` tag, e.g., `datetime:"2006-01-02"`. The
+// layout must produce a TOML offset datetime ("2006-01-02T15:04:05Z07:00"),
+// local datetime ("2006-01-02T15:04:05"), local date ("2006-01-02") or local
+// time ("15:04:05"), optionally with fractional seconds (".000" or ".999");
+// a space may be used instead of the 'T'. The local forms and the space need
+// TOML 0.5, so they're an error if the Encoder's Spec is TOML04 (but not by
+// default). With a custom layout, times are
+// formatted in their own location rather than converted to UTC. The
+// Encoder's TimeZone converts all datetimes to a given location instead.
+// Note that the decoder in this package only reads datetimes in the default
+// layout.
+//
+// A json.RawMessage is decoded and written as the corresponding TOML value,
+// e.g., a JSON object as a table and a JSON array as an array, so JSON data
+// can be embedded without knowing its structure. Its numbers are written as
+// with json.Number, and a JSON null is treated like nil.
+//
+// The Null types of database/sql (sql.NullString, sql.NullInt64, etc.) are
+// written as the value they hold if it is Valid, and are treated like nil
+// otherwise.
+//
+// A struct field with `modifier:"embedded_toml"` is encoded as a separate
+// TOML document (with the same Encoder options), which is written as a string
+// value of the field's key. This is useful for opaque configuration, e.g., of
+// plugins, that is stored inside another document.
+//
+// The `modifier` tag may list several modifiers separated by commas, e.g.,
+// `modifier:"embedded_toml,multiline_string"` to write an embedded document
+// as a multi-line string. The embedded_toml modifier is applied first, and
+// the others apply to the string it produces. At most one of the other
+// modifiers may apply to a field, since they each change how its value is
+// represented; combining two of them (such as multiline_string and
+// multiline_rawstring) is an error.
+//
+// An int32 (rune) struct field, or array of them, with `modifier:"rune"` is
+// written as strings holding the characters, e.g., "A" instead of 65. Since
+// rune is an alias of int32, other int32 fields are always written as
+// integers.
+//
+// The `tomlorder` tag changes the order in which the fields of a struct are
+// written: fields with the tag are written first, by increasing order (e.g.,
+// `tomlorder:"1"` before `tomlorder:"2"`), followed by the fields without it.
+// Fields with the same order are written in the order they're declared. Keys
+// are still written before tables, so the order only applies within each.
+//
 // If a Go map is encoded, then its keys are sorted alphabetically for
 // deterministic output. More control over this behavior may be provided if
-// there is demand for it.
+// there is demand for it. Keys that aren't strings are converted to one with
+// their MarshalText method if they implement TextMarshaler, with their String
+// method if they implement fmt.Stringer, or as a decimal number if they're
+// integers; the converted keys are sorted as strings.
 //
 // Encoding Go values without a corresponding TOML representation---like map
-// types with non-string keys---will cause an error to be returned. Similarly
-// for mixed arrays/slices, arrays/slices with nil elements, embedded
-// non-struct types and nested slices containing maps or structs.
+// types with other key types---will cause an error to be returned. Similarly
+// for mixed arrays/slices (unless the Encoder's AllowMixedArrays is set for
+// TOML 1.0), arrays/slices with nil elements (unless the Encoder's
+// SkipNilArrayElements is set), embedded non-struct types (without a name
+// given by their tag) and nested slices containing maps or structs.
 // (e.g., [][]map[string]string is not allowed but []map[string]string is OK
-// and so is []map[string][]string.)
+// and so are []map[string][]string and map[string][]map[string]string, whose
+// values are written as arrays of tables under each map key.)
 func (enc *Encoder) Encode(v interface{}) error {
-	rv := eindirect(reflect.ValueOf(v))
-	if err := enc.safeEncode(Key([]string{}), rv); err != nil {
+	return enc.EncodeUnder(NewKey(), v)
+}
+
+// EncodeUnder encodes v, which must be a map or struct (or a slice of them),
+// as if it were the value of the table with the key prefix, so that the
+// output can be spliced into a larger document under that key without
+// wrapping v in other maps or structs. For example, encoding a struct with
+// the prefix ["a", "b"] writes an [a.b] header followed by the struct's
+// keys, and its tables as [a.b.sub]. A slice of maps or structs is written
+// as the array of tables [[a.b]]. Headers and keys are indented as they would
+// be in the larger document. The pieces of prefix are quoted like any other
+// key if they aren't bare keys, e.g., ["a/b"]; with StrictKeys, blank pieces
+// are an error. An empty prefix encodes v just as Encode does. SingleLine
+// can't be used with a non-empty prefix.
+func (enc *Encoder) EncodeUnder(prefix Key, v interface{}) error {
+	if !enc.Canonical && !isValidIndent(enc.Indent) {
+		return errInvalidIndent
+	}
+	if !enc.Canonical && !isValidSeparator(enc.KeyValueSeparator) {
+		return errInvalidSeparator
+	}
+	enc.depth, enc.written, enc.stats = 0, 0, EncodeStats{}
+	enc.visited, enc.headers = nil, nil
+	enc.collecting, enc.collected, enc.writeErr = enc.CollectErrors, nil, nil
+	enc.flushTables = 0
+	rv := eindirect(valueOf(v))
+	err := enc.safeEncode(prefix, rv)
+	enc.collecting = false
+	errs := enc.collected
+	enc.collected = nil
+	if err != nil {
 		return err
 	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return enc.w.Flush()
 }
 
-func (enc *Encoder) safeEncode(key Key, rv reflect.Value) (err error) {
+// BytesWritten returns the number of bytes written by the last call to
+// Encode, including those of a partial document if it failed. Bytes written
+// by the Write* methods since then are included too.
+func (enc *Encoder) BytesWritten() int {
+	return enc.written
+}
+
+// Stats returns the structure of the output written by the last call to
+// Encode, including that of a partial document if it failed. Output written
+// by the Write* methods since then is included too, as for BytesWritten.
+func (enc *Encoder) Stats() EncodeStats {
+	stats := enc.stats
+	stats.Bytes = enc.written
+	return stats
+}
+
+// valueOf returns the reflect.Value of v, unless v is already a reflect.Value
+// (or a pointer to one), in which case that is returned instead of a Value
+// holding the reflect.Value struct itself.
+func valueOf(v interface{}) reflect.Value {
+	switch v := v.(type) {
+	case reflect.Value:
+		return v
+	case *reflect.Value:
+		if v == nil {
+			return reflect.Value{}
+		}
+		return *v
+	}
+	return reflect.ValueOf(v)
+}
+
+func (enc *Encoder) safeEncode(key Key, rv reflect.Value) error {
+	return enc.safe(func() {
+		if !rv.IsValid() {
+			// A nil value (or zero reflect.Value) isn't a table.
+			encPanic(errNoKey)
+		}
+		if len(key) > 0 {
+			if enc.SingleLine {
+				encPanic(errSingleLinePrefix)
+			}
+			enc.panicIfInvalidKey(key, true)
+			if !typeIsHash(enc.tomlTypeOfGo(rv)) {
+				encPanicKey(key, e("Value is not a table."))
+			}
+		}
+		enc.writeHeader()
+		if enc.SingleLine {
+			enc.eSingleLine(rv)
+		} else {
+			enc.encode(key, rv)
+		}
+		enc.endDocument()
+	})
+}
+
+// safe runs f, turning any encoding panic into an error.
+func (enc *Encoder) safe(f func()) (err error) {
 	defer func() {
+		enc.substitutes = nil
 		if r := recover(); r != nil {
 			if terr, ok := r.(tomlEncodeError); ok {
-				err = terr.error
+				enc.capture = nil
+				enc.writeNewlines()
+				err = &EncodeError{Key: terr.key, Offset: enc.written,
+					Err: terr.error}
 				return
 			}
 			panic(r)
 		}
 	}()
-	enc.encode(key, rv)
+	f()
 	return nil
 }
 
-func (enc *Encoder) encode(key Key, rv reflect.Value) {
-	// Special case. Time needs to be in ISO8601 format.
-	// Special case. If we can marshal the type to text, then we used that.
-	// Basically, this prevents the encoder for handling these types as
-	// generic structs (or whatever the underlying type of a TextMarshaler is).
-	switch rv.Interface().(type) {
-	case time.Time, TextMarshaler:
-		enc.keyEqElement(key, rv)
-		return
-	}
+// The Write* methods below allow a document to be written piece by piece
+// instead of (or in addition to) encoding whole Go values with Encode. They
+// write exactly what Encode would for the same piece: the Header (if nothing
+// has been written yet), a blank line before top-level table headers and
+// array of tables headers (unless nothing has been written yet), and
+// indentation according to the length of the key. Every call ends with a
+// newline and flushes the output to the underlying io.Writer.
 
-	k := rv.Kind()
-	switch k {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
-		reflect.Uint64,
-		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool:
-		enc.keyEqElement(key, rv)
+// WriteComment writes a comment, with each line (split on "\n") prefixed by
+// "# ".
+func (enc *Encoder) WriteComment(comment string) error {
+	return enc.writeManual(func() {
+		for _, line := range strings.Split(comment, "\n") {
+			enc.wf("# %s\n", line)
+		}
+	})
+}
+
+// WriteTableHeader writes a table header ([a.b]) for the key given.
+func (enc *Encoder) WriteTableHeader(key Key) error {
+	return enc.writeManual(func() {
+		if len(key) == 0 {
+			encPanic(errNoKey)
+		}
+		enc.tableHeader(key)
+	})
+}
+
+// WriteArrayTableHeader writes an array of tables header ([[a.b]]) for the
+// key given.
+func (enc *Encoder) WriteArrayTableHeader(key Key) error {
+	return enc.writeManual(func() {
+		if len(key) == 0 {
+			encPanic(errNoKey)
+		}
+		enc.panicIfInvalidKey(key, true)
+		enc.arrayTableHeader(key)
+	})
+}
+
+// ArrayTableWriter writes the elements of an array of tables one at a time,
+// so that they don't all have to be in memory at once. It is returned by
+// Encoder.BeginArrayTable.
+type ArrayTableWriter struct {
+	enc *Encoder
+	key Key
+}
+
+// BeginArrayTable returns an ArrayTableWriter for the array of tables with
+// the key given. Nothing is written until Append is called.
+//
+// Nothing else should be written with enc while the array is being written,
+// since anything written after an element would belong to that element (and
+// any table written in between would end the array).
+func (enc *Encoder) BeginArrayTable(key Key) *ArrayTableWriter {
+	return &ArrayTableWriter{enc: enc, key: key}
+}
+
+// Append writes v, which must be a map or struct (or a pointer to one), as
+// the next element of the array of tables: a [[key]] header followed by the
+// contents of v, encoded just as Encode would encode them. The output is
+// flushed before Append returns.
+func (w *ArrayTableWriter) Append(v interface{}) error {
+	enc, key := w.enc, w.key
+	return enc.writeManual(func() {
+		if len(key) == 0 {
+			encPanic(errNoKey)
+		}
+		enc.panicIfInvalidKey(key, true)
+		rv := eindirect(valueOf(v))
+		if !typeEqual(tomlHash, enc.tomlTypeOfGo(rv)) {
+			encPanicKey(key, e("Value is not a table."))
+		}
+		if enc.filtered(key, rv) {
+			return
+		}
+		enc.arrayTableHeader(key)
+		enc.eMapOrStruct(key, rv)
+	})
+}
+
+// EncodeStream writes every value received from ch as an element of the
+// array of tables with the key given, until ch is closed, just as Append of
+// an ArrayTableWriter would. Only one element is held in memory at a time,
+// so arrays of any length (e.g., rows read from a database cursor) can be
+// written.
+//
+// EncodeStream stops at the first value that can't be written (e.g., one
+// that isn't a map or struct) and returns its error, without receiving any
+// more values from ch; senders should be able to stop (e.g., by selecting on
+// a done channel) so that they aren't blocked forever. Elements written
+// before the error have been flushed.
+func (enc *Encoder) EncodeStream(key Key, ch <-chan interface{}) error {
+	w := enc.BeginArrayTable(key)
+	for v := range ch {
+		if err := w.Append(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteKeyValue writes `name = value`, where name is the last piece of the
+// key and value is v encoded just as Encode would encode it. The key should
+// include the table that the value belongs to, which determines the
+// indentation. Values that would be encoded as tables return an error; use
+// WriteTableHeader for those instead.
+func (enc *Encoder) WriteKeyValue(key Key, v interface{}) error {
+	return enc.writeManual(func() {
+		rv := valueOf(v)
+		if typeIsHash(enc.tomlTypeOfGo(rv)) {
+			encPanicKey(key, e("Value is a table."))
+		}
+		if !rv.IsValid() || enc.isNil(rv) {
+			encPanicKey(key, e("Value is nil."))
+		}
+		enc.encode(key, rv)
+	})
+}
+
+func (enc *Encoder) writeManual(f func()) error {
+	err := enc.safe(func() {
+		enc.modifier = MOD_NONE
+		enc.writeHeader()
+		f()
+		enc.endDocument()
+	})
+	if err != nil {
+		return err
+	}
+	return enc.w.Flush()
+}
+
+// writeHeader writes the SchemaComment and Header comments if nothing has
+// been written yet.
+func (enc *Encoder) writeHeader() {
+	if (enc.Header == "" && enc.SchemaComment == "") || enc.hasWritten {
+		return
+	}
+	if enc.SchemaComment != "" {
+		if strings.ContainsAny(enc.SchemaComment, "\r\n") {
+			encPanic(errSchemaNewline)
+		}
+		enc.wf("#:schema %s\n", enc.SchemaComment)
+	}
+	if enc.Header != "" {
+		// The header is indented like top-level keys.
+		indent := enc.indentStr(NewKey(""))
+		header := strings.TrimRight(enc.Header, "\n")
+		for _, line := range strings.Split(header, "\n") {
+			if line == "" {
+				enc.wf("%s#\n", indent)
+			} else {
+				enc.wf("%s# %s\n", indent, line)
+			}
+		}
+	}
+	enc.wf("\n")
+	// The comments are followed by a blank line, so the first entry is
+	// written as if it were the start of the document.
+	enc.hasWritten = false
+}
+
+func (enc *Encoder) encode(key Key, rv reflect.Value) {
+	defer enc.enter(key, rv)()
+
+	// Special case. Time needs to be in ISO8601 format.
+	// Special case. If we can marshal the type to text, then we used that.
+	// Basically, this prevents the encoder for handling these types as
+	// generic structs (or whatever the underlying type of a TextMarshaler is).
+	if _, _, ok := enc.typeEncoderFor(rv); ok {
+		enc.keyEqElement(key, rv)
+		return
+	}
+	enc.checkJSONRawMessage(rv)
+	if v, ok := enc.substituteValue(rv); ok {
+		if v.IsValid() {
+			enc.encode(key, v)
+		}
+		return
+	}
+	switch rv.Interface().(type) {
+	case time.Time, url.URL, Null:
+		enc.keyEqElement(key, rv)
+		return
+	}
+	if enc.isTextMarshaler(rv) || enc.isErrorString(rv) ||
+		enc.isEnumString(rv) {
+		enc.keyEqElement(key, rv)
+		return
+	}
+
+	k := rv.Kind()
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool:
+		enc.keyEqElement(key, rv)
+	case reflect.Complex64, reflect.Complex128:
+		if !enc.ComplexAsString {
+			encPanicKey(key, unsupportedType(rv))
+		}
+		enc.keyEqElement(key, rv)
 	case reflect.Array, reflect.Slice:
-		if typeEqual(tomlArrayHash, tomlTypeOfGo(rv)) {
+		if typeEqual(tomlArrayHash, enc.tomlTypeOfGo(rv)) {
 			enc.eArrayOfTables(key, rv)
 		} else {
 			enc.keyEqElement(key, rv)
@@ -164,22 +1505,290 @@ func (enc *Encoder) encode(key Key, rv reflect.Value) {
 	case reflect.Struct:
 		enc.eTable(key, rv)
 	default:
-		panic(e("Unsupported type for key '%s': %s", key, k))
+		encPanicKey(key, unsupportedType(rv))
+	}
+}
+
+// enter checks for cancellation, the MaxDepth limit and cycles before the
+// value rv of key is written. The returned function must be called once rv
+// has been written.
+func (enc *Encoder) enter(key Key, rv reflect.Value) (leave func()) {
+	enc.checkContext()
+	enc.depth++
+	if enc.MaxDepth > 0 && enc.depth > enc.MaxDepth {
+		encPanic(ErrMaxDepth)
+	}
+	ref, ok := refOf(rv)
+	if ok {
+		if enc.visited[ref] {
+			encPanic(e("%s: '%s'", errCyclicReference, key.Format()))
+		}
+		if enc.visited == nil {
+			enc.visited = make(map[visitedRef]bool)
+		}
+		enc.visited[ref] = true
+	}
+	return func() {
+		enc.depth--
+		if ok {
+			delete(enc.visited, ref)
+		}
+		// Record the innermost key in encoding errors.
+		if r := recover(); r != nil {
+			if terr, isEnc := r.(tomlEncodeError); isEnc {
+				if !terr.keySet {
+					terr.key, terr.keySet = key, true
+					r = terr
+				}
+				if enc.collect(terr) {
+					return
+				}
+			}
+			panic(r)
+		}
+	}
+}
+
+// collect records terr for CollectErrors, and resets the state of the value
+// that was being written, so that encoding can carry on with the next key. It
+// returns false if terr must stop encoding instead.
+func (enc *Encoder) collect(terr tomlEncodeError) bool {
+	if !enc.collecting || enc.isFatal(terr.error) {
+		return false
+	}
+	enc.collected = append(enc.collected, &EncodeError{Key: terr.key,
+		Offset: enc.written, Err: terr.error})
+	enc.modifier = MOD_NONE
+	enc.timeLayout = ""
+	enc.comment = ""
+	enc.arrayDepth = 0
+	enc.asString = false
+	enc.text = nil
+	enc.dotted = 0
+	enc.capture = nil
+	return true
+}
+
+// isFatal reports whether err stops encoding even with CollectErrors.
+func (enc *Encoder) isFatal(err error) bool {
+	return err == ErrMaxDepth || err == ErrMaxBytes || err == enc.writeErr ||
+		(enc.ctx != nil && err == enc.ctx.Err())
+}
+
+// quietly runs f, which only measures or inspects a value that is written
+// later, without collecting its errors for CollectErrors: they're collected
+// when the value is written, so that each is only recorded once. While
+// collecting, it reports whether f failed with such an error instead of
+// panicking.
+func (enc *Encoder) quietly(f func()) (ok bool) {
+	collecting := enc.collecting
+	enc.collecting = false
+	defer func() {
+		enc.collecting = collecting
+		if r := recover(); r != nil {
+			terr, isEnc := r.(tomlEncodeError)
+			if !isEnc || !collecting || enc.isFatal(terr.error) {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
+
+// classifiable reports whether the TOML type of rv, the value of key, can be
+// determined, e.g., that it isn't an array with mixed element types. If it
+// can't, the error is recorded for CollectErrors, so that key can be left
+// out of the table it's in rather than stopping the whole table. It is only
+// used while collecting errors.
+func (enc *Encoder) classifiable(key Key, rv reflect.Value) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			terr, isEnc := r.(tomlEncodeError)
+			if !isEnc {
+				panic(r)
+			}
+			if !terr.keySet {
+				terr.key, terr.keySet = key, true
+			}
+			if !enc.collect(terr) {
+				panic(terr)
+			}
+		}
+	}()
+	enc.tomlTypeOfGo(rv)
+	return true
+}
+
+// filtered reports whether the value rv of key is left out by FieldFilter.
+func (enc *Encoder) filtered(key Key, rv reflect.Value) bool {
+	return enc.FieldFilter != nil && !enc.FieldFilter(key, rv)
+}
+
+// unsupportedType returns an error for a value that has no TOML
+// representation.
+func unsupportedType(rv reflect.Value) error {
+	return e("%s %s", errUnsupportedType, rv.Type())
+}
+
+// nilDefault returns an empty slice or map in place of rv if rv is a nil
+// slice or map (or an interface holding one) and EmitEmptyContainers is set,
+// the zero value of a scalar type in place of a nil pointer to one if
+// EmitNilPointersAsZero is set, and otherwise rv itself.
+func (enc *Encoder) nilDefault(rv reflect.Value) reflect.Value {
+	v := rv
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch {
+	case v.Kind() == reflect.Slice && v.IsNil() && enc.EmitEmptyContainers:
+		return reflect.MakeSlice(v.Type(), 0, 0)
+	case v.Kind() == reflect.Map && v.IsNil() && enc.EmitEmptyContainers:
+		return reflect.MakeMap(v.Type())
+	case v.Kind() == reflect.Ptr && v.IsNil() && enc.EmitNilPointersAsZero:
+		zero := reflect.Zero(v.Type().Elem())
+		if zero.Kind() == reflect.Ptr || zero.Kind() == reflect.Interface {
+			break
+		}
+		typ := enc.tomlTypeOfGo(zero)
+		if typ != nil && !typeIsHash(typ) && !typeEqual(typ, tomlArray) {
+			return zero
+		}
+	}
+	return rv
+}
+
+// isUnsupported reports whether rv is left out for SkipUnsupported.
+func (enc *Encoder) isUnsupported(rv reflect.Value) bool {
+	if !enc.SkipUnsupported || enc.isNil(rv) {
+		return false
+	}
+	rv = eindirect(rv)
+	switch rv.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Uintptr, reflect.UnsafePointer:
+		return true
+	case reflect.Complex64, reflect.Complex128:
+		return !enc.ComplexAsString
+	case reflect.Struct:
+		// Structs encoded as another value aren't empty tables.
+		if !typeEqual(enc.tomlTypeOfGo(rv), tomlHash) || rv.NumField() == 0 ||
+			rv.Type() == syncMapType || rv.Type().Implements(tomlValuerType) {
+			return false
+		}
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			if rt.Field(i).PkgPath == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// visitedRef identifies a pointer, map or slice for cycle detection. The type
+// is included so that a pointer to a struct and a pointer to its first field
+// aren't considered the same.
+type visitedRef struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// refOf returns the reference held by rv if it is a value that could be part
+// of a cycle.
+func refOf(rv reflect.Value) (visitedRef, bool) {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map:
+		if rv.IsNil() {
+			return visitedRef{}, false
+		}
+	case reflect.Slice:
+		if rv.Len() == 0 {
+			return visitedRef{}, false
+		}
+	default:
+		return visitedRef{}, false
 	}
+	return visitedRef{rv.Pointer(), rv.Type()}, true
 }
 
 // eElement encodes any value that can be an array element (primitives and
 // arrays).
 func (enc *Encoder) eElement(rv reflect.Value) {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			encPanicKey(enc.elementKey, errNilValue)
+		}
+	}
+	if te, v, ok := enc.typeEncoderFor(rv); ok {
+		b, err := te.fn(v.Interface())
+		if err != nil {
+			encPanic(err)
+		}
+		if te.raw {
+			enc.wf("%s", b)
+		} else {
+			enc.writeQuoted(string(b))
+		}
+		return
+	}
+	enc.checkJSONRawMessage(rv)
+	if v, ok := enc.substituteValue(rv); ok {
+		// Invalid values are nil, and so never written.
+		enc.eElement(v)
+		return
+	}
 	switch v := rv.Interface().(type) {
+	case url.URL:
+		// Special case. url.URL doesn't implement TextMarshaler, and only
+		// *url.URL has a String method.
+		enc.writeQuoted(v.String())
+		return
+	case Null:
+		enc.writeQuoted(enc.NullRepresentation)
+		return
+	case *url.URL:
+		enc.writeQuoted(v.String())
+		return
 	case time.Time:
 		// Special case time.Time as a primitive. Has to come before
 		// TextMarshaler below because time.Time implements
-		// encoding.TextMarshaler, but we need to always use UTC.
-		enc.wf(v.In(time.FixedZone("UTC", 0)).Format("2006-01-02T15:04:05Z"))
+		// encoding.TextMarshaler, but we need to always use UTC (or the
+		// TimeZone).
+		if enc.TimeZone != nil {
+			v = v.In(enc.TimeZone)
+		}
+		if enc.timeLayout != "" {
+			enc.wf(v.Format(enc.timeLayout))
+			return
+		}
+		if enc.TimeZone != nil {
+			enc.wf(v.Format("2006-01-02T15:04:05.999999999Z07:00"))
+			return
+		}
+		enc.wf(v.In(time.FixedZone("UTC", 0)).Format(
+			"2006-01-02T15:04:05.999999999Z"))
+		return
+	case *time.Time:
+		// *time.Time implements TextMarshaler too, but is written as the
+		// datetime it points to (e.g., for the elements of a []*time.Time).
+		enc.eElement(rv.Elem())
+		return
+	case json.Number:
+		enc.writeJSONNumber(v)
 		return
 	case TextMarshaler:
 		// Special case. Use text marshaler if it's available for this value.
+		if enc.IgnoreTextMarshaler {
+			break
+		}
+		if enc.text != nil {
+			enc.writeQuoted(string(enc.text))
+			enc.text = nil
+			return
+		}
 		if s, err := v.MarshalText(); err != nil {
 			encPanic(err)
 		} else {
@@ -187,27 +1796,186 @@ func (enc *Encoder) eElement(rv reflect.Value) {
 		}
 		return
 	}
+	if enc.isErrorString(rv) {
+		enc.writeQuoted(rv.Interface().(error).Error())
+		return
+	}
+	if enc.isEnumString(rv) {
+		enc.writeQuoted(rv.Interface().(fmt.Stringer).String())
+		return
+	}
 	switch rv.Kind() {
 	case reflect.Bool:
-		enc.wf(strconv.FormatBool(rv.Bool()))
+		enc.writeBool(rv.Bool())
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		enc.wf(strconv.FormatInt(rv.Int(), 10))
+		if (enc.modifier == MOD_RUNE || enc.modifier == MOD_RUNES) &&
+			rv.Kind() == reflect.Int32 {
+			r := rune(rv.Int())
+			if !utf8.ValidRune(r) {
+				encPanicKey(enc.elementKey, e("Invalid rune %d.", rv.Int()))
+			}
+			enc.writeQuoted(string(r))
+			return
+		}
+		enc.wf(enc.signed(strconv.FormatInt(rv.Int(), 10)))
 	case reflect.Uint, reflect.Uint8, reflect.Uint16,
 		reflect.Uint32, reflect.Uint64:
-		enc.wf(strconv.FormatUint(rv.Uint(), 10))
+		enc.wf(enc.signed(strconv.FormatUint(rv.Uint(), 10)))
 	case reflect.Float32:
-		enc.wf(floatAddDecimal(strconv.FormatFloat(rv.Float(), 'f', -1, 32)))
+		enc.writeFloat(rv.Float(), 32)
 	case reflect.Float64:
-		enc.wf(floatAddDecimal(strconv.FormatFloat(rv.Float(), 'f', -1, 64)))
+		enc.writeFloat(rv.Float(), 64)
 	case reflect.Array, reflect.Slice:
+		if enc.modifier == MOD_RUNES &&
+			rv.Type().Elem().Kind() == reflect.Int32 {
+			enc.writeRunes(rv)
+			return
+		}
 		enc.eArrayOrSliceElement(rv)
 	case reflect.Interface:
 		enc.eElement(rv.Elem())
 	case reflect.String:
-		enc.writeQuoted(rv.String())
+		enc.writeString(rv.String())
+	case reflect.Complex64:
+		if !enc.ComplexAsString {
+			encPanicKey(enc.elementKey, unsupportedType(rv))
+		}
+		enc.writeQuoted(fmt.Sprint(complex64(rv.Complex())))
+	case reflect.Complex128:
+		if !enc.ComplexAsString {
+			encPanicKey(enc.elementKey, unsupportedType(rv))
+		}
+		enc.writeQuoted(fmt.Sprint(rv.Complex()))
+	case reflect.Ptr:
+		enc.eElement(rv.Elem())
+	case reflect.Map, reflect.Struct:
+		enc.eInlineTable(enc.elementKey, rv)
 	default:
-		panic(e("Unexpected primitive type: %s", rv.Kind()))
+		encPanicKey(enc.elementKey, unsupportedType(rv))
+	}
+}
+
+// writeRunes writes the slice or array of runes rv as a string, for
+// MOD_RUNES.
+func (enc *Encoder) writeRunes(rv reflect.Value) {
+	runes := make([]rune, rv.Len())
+	for i := range runes {
+		runes[i] = rune(rv.Index(i).Int())
+		if !utf8.ValidRune(runes[i]) {
+			encPanicKey(enc.elementKey, e("Invalid rune %d at index %d.",
+				runes[i], i))
+		}
+	}
+	enc.writeQuoted(string(runes))
+}
+
+// isEnumString reports whether rv should be encoded as the string returned by
+// its String method. This only happens when EnumAsString is enabled.
+func (enc *Encoder) isEnumString(rv reflect.Value) bool {
+	if !enc.EnumAsString || enc.isTextMarshaler(rv) {
+		return false
+	}
+	_, ok := rv.Interface().(fmt.Stringer)
+	return ok
+}
+
+// isTextMarshaler reports whether rv is encoded as the string returned by
+// its MarshalText method, which is the case unless IgnoreTextMarshaler is
+// set.
+func (enc *Encoder) isTextMarshaler(rv reflect.Value) bool {
+	if enc.IgnoreTextMarshaler {
+		return false
+	}
+	_, ok := rv.Interface().(TextMarshaler)
+	return ok
+}
+
+// isErrorString reports whether rv should be encoded as the string returned
+// by its Error method. This only happens when ErrorAsString is enabled.
+func (enc *Encoder) isErrorString(rv reflect.Value) bool {
+	if !enc.ErrorAsString || enc.isTextMarshaler(rv) {
+		return false
+	}
+	_, ok := rv.Interface().(error)
+	return ok
+}
+
+// tomlDatetimeRegexp matches the TOML datetime, date and time literals that
+// can be produced by a layout given in a `datetime` struct tag.
+var tomlDatetimeRegexp = regexp.MustCompile(`^(?:` +
+	`\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2})?)?` +
+	`|\d{2}:\d{2}:\d{2}(?:\.\d+)?)$`)
+
+// toml04DatetimeRegexp is like tomlDatetimeRegexp, but for TOML 0.4, which
+// only has offset datetimes.
+var toml04DatetimeRegexp = regexp.MustCompile(
+	`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2})$`)
+
+// isValidTimeLayout reports whether layout formats times as TOML literals of
+// the given version. It is checked by formatting times that exercise every
+// part of a layout (e.g., a zero and a non-zero offset and fractional second).
+func isValidTimeLayout(layout string, spec Spec) bool {
+	re := tomlDatetimeRegexp
+	if spec == TOML04 {
+		re = toml04DatetimeRegexp
+	}
+	for _, t := range []time.Time{
+		time.Date(2006, 1, 2, 15, 4, 5, 123456789, time.FixedZone("", -7*3600)),
+		time.Date(2006, 11, 12, 3, 14, 15, 0, time.UTC),
+	} {
+		if !re.MatchString(t.Format(layout)) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFloat writes a float of the given bit size. NaN and infinities can
+// only be written since TOML 0.5.
+func (enc *Encoder) writeFloat(f float64, bitSize int) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		if enc.Spec < TOML05 {
+			encPanicKey(enc.elementKey, e("Can't encode %v in TOML 0.4.", f))
+		}
+		switch {
+		case math.IsNaN(f):
+			enc.wf("nan")
+		case f > 0:
+			enc.wf(enc.signed("inf"))
+		default:
+			enc.wf("-inf")
+		}
+		return
+	}
+	enc.wf(enc.signed(floatAddDecimal(strconv.FormatFloat(f, 'f', -1,
+		bitSize))))
+}
+
+// writeBool writes a boolean. The only boolean literals in TOML are true and
+// false, so any other spelling (from BoolAsString) is written as a string.
+func (enc *Encoder) writeBool(b bool) {
+	if enc.BoolAsString != nil {
+		if b {
+			enc.writeQuoted(enc.BoolAsString[0])
+		} else {
+			enc.writeQuoted(enc.BoolAsString[1])
+		}
+		return
+	}
+	if b {
+		enc.wf("true")
+	} else {
+		enc.wf("false")
+	}
+}
+
+// signed returns the formatted number s with a plus sign for ExplicitSign,
+// unless it's negative.
+func (enc *Encoder) signed(s string) string {
+	if !enc.ExplicitSign || enc.Canonical || strings.HasPrefix(s, "-") {
+		return s
 	}
+	return "+" + s
 }
 
 // By the TOML spec, all floats must have a decimal with at least one
@@ -220,14 +1988,23 @@ func floatAddDecimal(fstr string) string {
 }
 
 func (enc *Encoder) writeQuoted(s string) {
-	enc.wf("\"%s\"", quotedReplacer.Replace(s))
+	escaper := enc.StringEscaper
+	if escaper == nil {
+		escaper = DefaultStringEscaper
+	}
+	enc.wf("\"%s\"", escaper.Escape(s))
 }
 
 func (enc *Encoder) eArrayOrSliceElement(rv reflect.Value) {
-	length := rv.Len()
+	elems := enc.arrayElements(rv)
+	length := len(elems)
+	if length > 0 && enc.expandArray(rv) {
+		enc.eArrayExpanded(elems)
+		return
+	}
 	enc.wf("[")
-	for i := 0; i < length; i++ {
-		elem := rv.Index(i)
+	for i, elem := range elems {
+		enc.checkContext()
 		enc.eElement(elem)
 		if i != length-1 {
 			enc.wf(", ")
@@ -236,141 +2013,1274 @@ func (enc *Encoder) eArrayOrSliceElement(rv reflect.Value) {
 	enc.wf("]")
 }
 
-func (enc *Encoder) eArrayOfTables(key Key, rv reflect.Value) {
-	if len(key) == 0 {
-		encPanic(errNoKey)
-	}
-	panicIfInvalidKey(key, true)
+// arrayElements returns the elements of the array or slice rv that are
+// written, which is all of them unless SkipNilArrayElements is set.
+func (enc *Encoder) arrayElements(rv reflect.Value) []reflect.Value {
+	elems := make([]reflect.Value, 0, rv.Len())
 	for i := 0; i < rv.Len(); i++ {
-		trv := rv.Index(i)
-		if isNil(trv) {
+		elem := rv.Index(i)
+		if enc.SkipNilArrayElements && enc.tomlTypeOfGo(elem) == nil {
 			continue
 		}
-		enc.newline()
-		enc.wf("%s[[%s]]", enc.indentStr(key), key.String())
-		enc.newline()
-		enc.eMapOrStruct(key, trv)
+		elems = append(elems, elem)
 	}
+	return elems
 }
 
-func (enc *Encoder) eTable(key Key, rv reflect.Value) {
-	if len(key) == 1 {
-		// Output an extra new line between top-level tables.
-		// (The newline isn't written if nothing else has been written though.)
-		enc.newline()
-	}
-	if len(key) > 0 {
-		panicIfInvalidKey(key, true)
-		enc.wf("%s[%s]", enc.indentStr(key), key.String())
-		enc.newline()
+func (enc *Encoder) eArrayExpanded(elems []reflect.Value) {
+	length := len(elems)
+	enc.arrayDepth++
+	indent := enc.arrayIndent()
+	enc.wf("[\n")
+	for i, elem := range elems {
+		enc.checkContext()
+		enc.wf("%s", indent)
+		enc.eElement(elem)
+		if i != length-1 || enc.TrailingComma {
+			enc.wf(",")
+		}
+		enc.wf("\n")
 	}
-	enc.eMapOrStruct(key, rv)
+	enc.arrayDepth--
+	enc.wf("%s]", enc.arrayIndent())
 }
 
-func (enc *Encoder) eMapOrStruct(key Key, rv reflect.Value) {
-	switch rv := eindirect(rv); rv.Kind() {
-	case reflect.Map:
-		enc.eMap(key, rv)
-	case reflect.Struct:
-		enc.eStruct(key, rv)
-	default:
-		panic("eTable: unhandled reflect.Value Kind: " + rv.Kind().String())
+// arrayIndent returns the indentation of the elements of the array being
+// written in expanded form.
+func (enc *Encoder) arrayIndent() string {
+	return enc.indentStr(enc.elementKey) +
+		strings.Repeat(enc.indentUnit(), enc.arrayDepth)
+}
+
+// expandArray reports whether rv should be written in expanded form.
+func (enc *Encoder) expandArray(rv reflect.Value) bool {
+	if enc.Canonical {
+		return false
+	}
+	switch enc.ArrayStyle {
+	case ArrayExpanded:
+		return true
+	case ArrayAuto:
+		width := enc.ArrayWidth
+		if width <= 0 {
+			width = 80
+		}
+		// The column at which the array starts.
+		col := len(enc.arrayIndent())
+		if enc.arrayDepth == 0 {
+			col += len(enc.elementKey[len(enc.elementKey)-1]) +
+				len(enc.separator())
+		}
+		return col+enc.compactLen(rv) > width
+	}
+	return false
+}
+
+// compactLen returns the length of rv written on a single line.
+func (enc *Encoder) compactLen(rv reflect.Value) int {
+	style := enc.ArrayStyle
+	defer func() { enc.ArrayStyle = style }()
+	enc.ArrayStyle = ArrayCompact
+	return enc.measure(func() { enc.eArrayOrSliceElement(rv) })
+}
+
+// measure returns the number of bytes written by f, without writing them.
+func (enc *Encoder) measure(f func()) int {
+	w, written, hasWritten, newlines := enc.w, enc.written, enc.hasWritten,
+		enc.newlines
+	stats, capture := enc.stats, enc.capture
+	defer func() {
+		enc.w, enc.written, enc.hasWritten, enc.newlines = w, written,
+			hasWritten, newlines
+		enc.stats, enc.capture = stats, capture
+	}()
+
+	enc.w = bufio.NewWriter(ioutil.Discard)
+	enc.written = 0
+	enc.newlines = 0
+	enc.capture = nil
+	enc.quietly(f)
+	return enc.written
+}
+
+// eInlineTable writes the map or struct rv as an inline table, such as
+// { a = 1, b = { c = 2 } }. Every table in it is written inline as well, and
+// arrays are written on a single line, so the whole table is on one line.
+func (enc *Encoder) eInlineTable(key Key, rv reflect.Value) {
+	defer enc.enter(key, rv)()
+	style, modifier, timeLayout := enc.ArrayStyle, enc.modifier, enc.timeLayout
+	defer func() {
+		enc.ArrayStyle, enc.modifier, enc.timeLayout = style, modifier,
+			timeLayout
+		enc.elementKey = key
+	}()
+	enc.ArrayStyle = ArrayCompact
+	enc.modifier = MOD_NONE
+	enc.timeLayout = ""
+
+	names, values, _ := enc.inlineFields(key, eindirect(rv))
+	if len(names) == 0 {
+		enc.wf("{}")
+		return
+	}
+	enc.wf("{ ")
+	for i, name := range names {
+		if i > 0 {
+			enc.wf(", ")
+		}
+		k := key.Add(name)
+		enc.panicIfInvalidKey(k, false)
+		enc.elementKey = k
+		enc.wf("%s%s", FormatKey(enc.KeyCase.apply(name)), enc.separator())
+		v := values[i]
+		if typeEqual(tomlArrayHash, enc.tomlTypeOfGo(v)) {
+			// Arrays of tables can only be written as arrays of inline
+			// tables here.
+			v = eindirect(v)
+			enc.wf("[")
+			first := true
+			for j := 0; j < v.Len(); j++ {
+				if enc.isNil(v.Index(j)) && !enc.SkipNilArrayElements {
+					encPanic(arrayNilElementError{j})
+				}
+				if enc.isNil(v.Index(j)) || enc.filtered(k, v.Index(j)) {
+					continue
+				}
+				if !first {
+					enc.wf(", ")
+				}
+				first = false
+				enc.eInlineTable(k, v.Index(j))
+			}
+			enc.wf("]")
+			continue
+		}
+		enc.eElement(v)
+	}
+	enc.wf(" }")
+}
+
+// eSingleLine writes the table rv as a whole document for SingleLine: every
+// key = value pair at the top level on its own line, with the tables in it
+// written as inline tables. The options of top-level struct fields apply as
+// they do in writeFields, except for multi-line string modifiers.
+func (enc *Encoder) eSingleLine(rv reflect.Value) {
+	defer enc.enter(NewKey(), rv)()
+	if v, ok := enc.substituteValue(rv); ok {
+		rv = v
+	}
+	rv = eindirect(rv)
+	if !typeEqual(tomlHash, enc.tomlTypeOfGo(rv)) {
+		encPanic(errNoKey)
+	}
+	style := enc.ArrayStyle
+	defer func() { enc.ArrayStyle = style }()
+	enc.ArrayStyle = ArrayCompact
+
+	names, values, tags := enc.inlineFields(NewKey(), rv)
+	for i, name := range names {
+		key := NewKey(name)
+		opts := getEncodeOptions(tags[i], enc.UseJSONTagFallback)
+		var embedded bool
+		enc.modifier, embedded = enc.fieldModifiers(key, tags[i],
+			values[i].Type())
+		if enc.modifier == MOD_MULTILINE_STRING ||
+			enc.modifier == MOD_MULTILINE_RAWSTRING {
+			enc.modifier = MOD_NONE
+		}
+		enc.asString = opts.asString
+		enc.timeLayout = enc.fieldTimeLayout(key, tags[i])
+		if embedded {
+			enc.eEmbedded(key, values[i])
+			continue
+		}
+		enc.keyEqElement(key, values[i])
+	}
+	enc.modifier, enc.asString, enc.timeLayout = MOD_NONE, false, ""
+}
+
+// inlineFields returns the keys and values of the map or struct rv that are
+// written in an inline table: map keys in sorted order, or struct fields in
+// the order they're declared. Nil, omitted and filtered values are left out.
+// The tags of struct fields are returned as well (empty for map keys).
+func (enc *Encoder) inlineFields(key Key, rv reflect.Value) (names []string,
+	values []reflect.Value, tags []reflect.StructTag) {
+
+	switch rv.Kind() {
+	case reflect.Map:
+		mapKeys, index := mapKeyStrings(rv)
+		for _, name := range mapKeys {
+			v := enc.nilDefault(index(name))
+			if enc.collecting && !enc.classifiable(key.Add(name), v) {
+				continue
+			}
+			if enc.tomlTypeOfGo(v) != nil && !enc.isUnsupported(v) &&
+				!enc.filtered(key.Add(name), v) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v := enc.nilDefault(index(name))
+			values = append(values, eindirect(v))
+			tags = append(tags, "")
+		}
+	case reflect.Struct:
+		var addFields func(rv reflect.Value)
+		addFields = func(rv reflect.Value) {
+			rt := rv.Type()
+			for i := 0; i < rt.NumField(); i++ {
+				sft, fv := rt.Field(i), rv.Field(i)
+				sf := enc.nilDefault(fv)
+				if sft.PkgPath != "" {
+					continue
+				}
+				if enc.isEmbedded(sft) {
+					if enc.isNil(sf) {
+						continue
+					}
+					sf = eindirect(sf)
+					if sf.Kind() != reflect.Struct {
+						encPanic(errAnonNonStruct)
+					}
+					addFields(sf)
+					continue
+				}
+				opts := getEncodeOptions(sft.Tag, enc.UseJSONTagFallback)
+				if enc.collecting && !opts.skip &&
+					!enc.classifiable(key.Add(enc.fieldName(sft)), sf) {
+					continue
+				}
+				if opts.skip || enc.isNil(sf) || enc.isUnsupported(sf) ||
+					(opts.omitempty && isEmpty(fv)) ||
+					(opts.omitzero && isZero(fv)) {
+					continue
+				}
+				if opts.omitempty {
+					if empty, _ := enc.emptyText(sf); empty {
+						continue
+					}
+				}
+				name := sft.Name
+				if opts.name != "" {
+					name = opts.name
+				}
+				if enc.filtered(key.Add(name), sf) {
+					continue
+				}
+				names = append(names, name)
+				values = append(values, eindirect(sf))
+				tags = append(tags, sft.Tag)
+			}
+		}
+		addFields(rv)
+	}
+	enc.checkKeyCase(key, names)
+	return names, values, tags
+}
+
+// writeInline reports whether the struct field sft, with value rv, is written
+// as an inline table under the table key. This is the case for tables with
+// the inline option, as long as the line with the inline table is no longer
+// than InlineTableWidth. Longer tables are written as standard tables.
+func (enc *Encoder) writeInline(key Key, sft reflect.StructField,
+	rv reflect.Value) bool {
+
+	opts := getEncodeOptions(sft.Tag, enc.UseJSONTagFallback)
+	if !opts.inline || opts.skip || enc.isNil(rv) ||
+		!typeEqual(tomlHash, enc.tomlTypeOfGo(rv)) {
+		return false
+	}
+	name := sft.Name
+	if opts.name != "" {
+		name = opts.name
+	}
+	width := enc.InlineTableWidth
+	if width <= 0 {
+		width = 80
+	}
+	k := key.Add(name)
+	elementKey := enc.elementKey
+	defer func() { enc.elementKey = elementKey }()
+	n := enc.measure(func() { enc.eInlineTable(k, rv) })
+	return len(enc.indentStr(k))+len(name)+len(enc.separator())+n <= width
+}
+
+// isDotted reports whether the table rv, with the key given, is written as
+// a dotted key for DottedKeys.
+func (enc *Encoder) isDotted(key Key, rv reflect.Value) bool {
+	_, _, ok := enc.dottedKey(key, rv)
+	return ok
+}
+
+// dottedKey returns the name and value of the single key of the table rv,
+// if the table is written as a dotted key for DottedKeys.
+func (enc *Encoder) dottedKey(key Key, rv reflect.Value) (string,
+	reflect.Value, bool) {
+
+	if !enc.DottedKeys || enc.Spec < TOML05 || enc.isNil(rv) ||
+		!typeEqual(tomlHash, enc.tomlTypeOfGo(rv)) {
+		return "", reflect.Value{}, false
+	}
+	rv = eindirect(rv)
+	if rv.Kind() == reflect.Struct && !enc.hasPlainFields(rv.Type()) {
+		return "", reflect.Value{}, false
+	}
+	var names []string
+	var values []reflect.Value
+	if !enc.quietly(func() { names, values, _ = enc.inlineFields(key, rv) }) {
+		return "", reflect.Value{}, false
+	}
+	if len(names) != 1 {
+		return "", reflect.Value{}, false
+	}
+	switch typ := enc.tomlTypeOfGo(values[0]); {
+	case typ == nil, typeIsHash(typ), typeEqual(typ, tomlArray):
+		return "", reflect.Value{}, false
+	}
+	return names[0], values[0], true
+}
+
+// eDotted writes the table rv as a dotted key if it's written that way for
+// DottedKeys, and reports whether it was.
+func (enc *Encoder) eDotted(key Key, rv reflect.Value) bool {
+	name, v, ok := enc.dottedKey(key, rv)
+	if !ok {
+		return false
+	}
+	defer enc.enter(key, rv)()
+	k := key.Add(name)
+	defer enc.enter(k, v)()
+	enc.modifier = MOD_NONE
+	enc.timeLayout = ""
+	enc.asString = false
+	enc.dotted = 1
+	enc.keyEqElement(k, v)
+	return true
+}
+
+// fieldName returns the key of the struct field sft.
+func (enc *Encoder) fieldName(sft reflect.StructField) string {
+	opts := getEncodeOptions(sft.Tag, enc.UseJSONTagFallback)
+	if opts.name != "" {
+		return opts.name
+	}
+	return sft.Name
+}
+
+// isEmbedded reports whether the fields of the struct field sft are written
+// as if they were fields of the struct that contains it. This is the case
+// for anonymous (embedded) fields, unless they're given a name by their tag,
+// in which case they're written like other fields (e.g., as a table).
+func (enc *Encoder) isEmbedded(sft reflect.StructField) bool {
+	return sft.Anonymous &&
+		getEncodeOptions(sft.Tag, enc.UseJSONTagFallback).name == ""
+}
+
+// walkFields calls field for every exported field of the struct type rt that
+// eStruct may write, with its index in rt (see reflect.Type.FieldByIndex).
+// The fields of embedded structs (see isEmbedded) are walked in place of the
+// embedded field, as if they were fields of rt, if embed returns true for
+// it; an embedded type that isn't a struct is an error. start is the index
+// of rt itself, when it is embedded.
+func (enc *Encoder) walkFields(rt reflect.Type, start []int,
+	embed func(index []int) bool,
+	field func(index []int, f reflect.StructField)) error {
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		// skip unexporded fields
+		if f.PkgPath != "" {
+			continue
+		}
+		index := make([]int, 0, len(start)+len(f.Index))
+		index = append(append(index, start...), f.Index...)
+		if !enc.isEmbedded(f) {
+			field(index, f)
+			continue
+		}
+		t := f.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return errAnonNonStruct
+		}
+		if !embed(index) {
+			continue
+		}
+		if err := enc.walkFields(t, index, embed, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeysOf returns the full keys that encoding a value of the struct type t (or
+// a pointer to one) could write, without needing a value: the key of every
+// field, as given by its tag, followed by the keys in it if it's a table or
+// an array of tables. The fields of embedded structs are included as if they
+// were fields of t, as when encoding. Keys that might be left out when
+// encoding, such as those of fields with omitempty, are included too. The
+// keys in maps and interface values depend on the value, so they aren't
+// included, and neither are the keys of a struct type inside itself (e.g.,
+// in the Next field of a linked list node). The Encoder's options that
+// change keys, such as UseJSONTagFallback and KeyCase, are applied.
+//
+// The keys are returned in the order the fields are declared in. An error is
+// returned if t isn't a struct type, or if it embeds a type that isn't a
+// struct (see Encode).
+func (enc *Encoder) KeysOf(t reflect.Type) ([]Key, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, e("toml: KeysOf called with non-struct type %s", t)
+	}
+	var keys []Key
+	seen := map[reflect.Type]bool{t: true}
+	if err := enc.keysOf(t, nil, seen, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// KeysOf is Encoder.KeysOf for an Encoder with the default options.
+func KeysOf(t reflect.Type) ([]Key, error) {
+	return NewEncoder(ioutil.Discard).KeysOf(t)
+}
+
+// keysOf appends the keys of the fields of the struct type rt, in the table
+// with the key given, to keys. The struct types that contain rt (including
+// rt itself) are in seen, so that recursive types are only walked once.
+func (enc *Encoder) keysOf(rt reflect.Type, key Key,
+	seen map[reflect.Type]bool, keys *[]Key) error {
+
+	var err error
+	embed := func([]int) bool { return true }
+	walkErr := enc.walkFields(rt, nil, embed, func(_ []int,
+		f reflect.StructField) {
+
+		opts := getEncodeOptions(f.Tag, enc.UseJSONTagFallback)
+		if err != nil || opts.skip {
+			return
+		}
+		k := key.Add(enc.fieldName(f))
+		*keys = append(*keys, enc.caseKey(k))
+
+		// Arrays of tables have the same keys as their elements.
+		t := f.Type
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+		}
+		if t.Kind() != reflect.Struct || seen[t] || !enc.isTableType(t) ||
+			hasModifier(f.Tag, MOD_EMBEDDED_TOML) {
+			return
+		}
+		seen[t] = true
+		err = enc.keysOf(t, k, seen, keys)
+		delete(seen, t)
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+// hasPlainFields reports whether none of the fields of the struct type rt
+// (including those of embedded structs) have tags that change how their
+// value is written, other than its name and whether it's left out.
+func (enc *Encoder) hasPlainFields(rt reflect.Type) bool {
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if enc.isEmbedded(f) {
+			t := f.Type
+			if t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t.Kind() == reflect.Struct && !enc.hasPlainFields(t) {
+				return false
+			}
+			continue
+		}
+		if f.Tag.Get("modifier") != "" || f.Tag.Get("datetime") != "" ||
+			f.Tag.Get("comment") != "" ||
+			getEncodeOptions(f.Tag, enc.UseJSONTagFallback).asString {
+			return false
+		}
+	}
+	return true
+}
+
+// eArrayOfTables writes every element of a slice or fixed-size array of
+// tables under its own [[key]] header. Elements that are zero-value structs
+// or empty maps are written as a header with no keys, since they are still
+// elements of the array.
+func (enc *Encoder) eArrayOfTables(key Key, rv reflect.Value) {
+	if len(key) == 0 {
+		encPanic(errNoKey)
+	}
+	enc.panicIfInvalidKey(key, true)
+	if max := enc.MaxArrayTableElements; max > 0 && rv.Len() > max {
+		encPanic(e("array of tables has %d elements, more than the "+
+			"maximum of %d", rv.Len(), max))
+	}
+	if enc.FoldSingleTableArrays && rv.Len() == 1 && !enc.isNil(rv.Index(0)) {
+		if !enc.filtered(key, rv.Index(0)) {
+			enc.eTable(key, rv.Index(0))
+		}
+		return
+	}
+	for i := 0; i < rv.Len(); i++ {
+		trv := rv.Index(i)
+		if enc.isNil(trv) || enc.filtered(key, trv) {
+			continue
+		}
+		enc.checkContext()
+		enc.arrayTableHeader(key)
+		enc.eMapOrStruct(key, trv)
+	}
+}
+
+func (enc *Encoder) arrayTableHeader(key Key) {
+	enc.flushInterval(key)
+	enc.writeParentTables(key)
+	enc.newline()
+	enc.writePendingComment(key)
+	enc.wf("%s[[%s]]", enc.indentStr(key), enc.caseKey(key).Format())
+	enc.newline()
+	enc.stats.ArrayTables++
+}
+
+func (enc *Encoder) eTable(key Key, rv reflect.Value) {
+	if len(key) > 0 {
+		enc.tableHeader(key)
+	}
+	enc.eMapOrStruct(key, rv)
+}
+
+func (enc *Encoder) tableHeader(key Key) {
+	enc.flushInterval(key)
+	if len(key) == 1 {
+		// Output an extra new line between top-level tables.
+		// (The newline isn't written if nothing else has been written though.)
+		enc.newline()
+	}
+	enc.panicIfInvalidKey(key, true)
+	enc.writeParentTables(key)
+	enc.writePendingComment(key)
+	enc.wf("%s[%s]", enc.indentStr(key), enc.caseKey(key).Format())
+	enc.newline()
+	enc.stats.Tables++
+}
+
+// flushInterval flushes the output before the header of key is written if
+// it is a top-level table and FlushInterval top-level tables have been
+// written since the output was last flushed.
+func (enc *Encoder) flushInterval(key Key) {
+	if enc.FlushInterval <= 0 || len(key) != 1 {
+		return
+	}
+	if enc.flushTables >= enc.FlushInterval {
+		if err := enc.w.Flush(); err != nil {
+			enc.writeErr = err
+			encPanic(err)
+		}
+		enc.flushTables = 0
+	}
+	enc.flushTables++
+}
+
+// writeParentTables writes a header for every table that contains key and
+// hasn't had its header written yet, if EmitParentTables is set. It also
+// records key itself as written.
+func (enc *Encoder) writeParentTables(key Key) {
+	if !enc.EmitParentTables {
+		return
+	}
+	if enc.headers == nil {
+		enc.headers = make(map[string]bool)
+	}
+	// The pending comment belongs to key, not to its parents.
+	comment := enc.comment
+	enc.comment = ""
+	for i := 1; i < len(key); i++ {
+		if parent := key[:i]; !enc.headers[parent.Format()] {
+			enc.tableHeader(parent)
+		}
+	}
+	enc.comment = comment
+	enc.headers[key.Format()] = true
+}
+
+// writePendingComment writes the comment of the struct field being encoded,
+// if it has one, indented to match key.
+func (enc *Encoder) writePendingComment(key Key) {
+	if enc.comment == "" {
+		return
+	}
+	for _, line := range strings.Split(enc.comment, "\n") {
+		enc.wf("%s# %s\n", enc.indentStr(key), line)
+	}
+	enc.comment = ""
+}
+
+// eMapOrStruct writes the keys and sub-tables of the maps or structs rvs,
+// which are all written as the same table. The keys of all of them are
+// written before any of their sub-tables.
+func (enc *Encoder) eMapOrStruct(key Key, rvs ...reflect.Value) {
+	timeLayout := enc.timeLayout
+	enc.timeLayout = ""
+	defer func() {
+		enc.timeLayout = timeLayout
+		// A comment that wasn't written (e.g., of a field that turned out
+		// to be empty) mustn't end up on the next header.
+		enc.comment = ""
+	}()
+	enc.comment = ""
+	enc.asString = false
+
+	directs := make([]func(), 0, len(rvs))
+	subs := make([]func(), 0, len(rvs))
+	for _, rv := range rvs {
+		var direct, sub func()
+		switch rv := eindirect(rv); rv.Kind() {
+		case reflect.Map:
+			direct, sub = enc.eMap(key, rv)
+		case reflect.Struct:
+			direct, sub = enc.eStruct(key, rv)
+		default:
+			encPanicKey(key, unsupportedType(rv))
+		}
+		directs = append(directs, direct)
+		subs = append(subs, sub)
+	}
+	enc.alignKeys(func() {
+		for _, direct := range directs {
+			direct()
+		}
+	})
+	for _, sub := range subs {
+		sub()
+	}
+}
+
+// alignMark is the position in the buffered output right after a key
+// written by keyEqElement, and the width of that key.
+type alignMark struct {
+	pos, width int
+}
+
+// alignKeys calls f, which writes the values of a table, and pads the keys
+// written by it for AlignValues. The output of f is buffered until the
+// widest key is known.
+func (enc *Encoder) alignKeys(f func()) {
+	if !enc.AlignValues || enc.Canonical {
+		f()
+		return
+	}
+	var buf bytes.Buffer
+	w, start := enc.w, enc.written
+	aligning, alignStart, marks := enc.aligning, enc.alignStart, enc.marks
+	defer func() {
+		enc.w = w
+		enc.aligning, enc.alignStart, enc.marks = aligning, alignStart, marks
+	}()
+	enc.w = bufio.NewWriter(&buf)
+	enc.aligning = true
+	enc.alignStart = start
+	enc.marks = nil
+	func() {
+		// The buffered output is lost if f fails.
+		defer func() {
+			if r := recover(); r != nil {
+				enc.written = start
+				panic(r)
+			}
+		}()
+		f()
+	}()
+	if err := enc.w.Flush(); err != nil {
+		encPanic(err)
+	}
+
+	width := 0
+	for _, m := range enc.marks {
+		if m.width > width {
+			width = m.width
+		}
+	}
+	out, pad := buf.String(), strings.Repeat(" ", width)
+	enc.w, enc.written = w, start
+	last := 0
+	for _, m := range enc.marks {
+		enc.write(out[last:m.pos])
+		enc.write(pad[m.width:])
+		last = m.pos
+	}
+	enc.write(out[last:])
+}
+
+// eMergedTable writes the maps or structs rvs as a single table with the key
+// given, for struct fields that have the same key. Writing them as separate
+// tables would define the table more than once, which is invalid.
+func (enc *Encoder) eMergedTable(key Key, rvs []reflect.Value) {
+	for _, rv := range rvs {
+		defer enc.enter(key, rv)()
 	}
+	enc.tableHeader(key)
+	enc.eMapOrStruct(key, rvs...)
 }
 
-func (enc *Encoder) eMap(key Key, rv reflect.Value) {
+// eMap returns functions that write the keys of the map rv that aren't
+// tables, and the keys that are, in that order.
+func (enc *Encoder) eMap(key Key, rv reflect.Value) (direct, sub func()) {
 	rt := rv.Type()
-	if rt.Key().Kind() != reflect.String {
-		encPanic(errNonString)
+	if !enc.noFastPath && enc.isPlainPrimitive(rt.Elem()) {
+		return func() { enc.ePrimitiveMap(key, rv) }, func() {}
 	}
 
 	// Sort keys so that we have deterministic output. And write keys directly
 	// underneath this key first, before writing sub-structs or sub-maps.
+	// Nil values (including pointers and interfaces holding nil) aren't
+	// written at all, so they are left out of both sets.
 	var mapKeysDirect, mapKeysSub []string
-	for _, mapKey := range rv.MapKeys() {
-		k := mapKey.String()
-		if typeIsHash(tomlTypeOfGo(rv.MapIndex(mapKey))) {
+	mapKeys, mapIndex := mapKeyStrings(rv)
+	index := func(k string) reflect.Value {
+		return enc.nilDefault(mapIndex(k))
+	}
+	for _, k := range mapKeys {
+		if enc.collecting && !enc.classifiable(key.Add(k), index(k)) {
+			continue
+		}
+		switch typ := enc.tomlTypeOfGo(index(k)); {
+		case typ == nil, enc.isUnsupported(index(k)):
+			continue
+		case typeIsHash(typ) && !enc.isDotted(key.Add(k), index(k)):
 			mapKeysSub = append(mapKeysSub, k)
-		} else {
+		default:
 			mapKeysDirect = append(mapKeysDirect, k)
 		}
 	}
 
+	enc.checkKeyCase(key, mapKeysDirect, mapKeysSub)
 	var writeMapKeys = func(mapKeys []string) {
-		sort.Strings(mapKeys)
+		enc.sortMapKeys(key, mapKeys)
 		for _, mapKey := range mapKeys {
-			mrv := rv.MapIndex(reflect.ValueOf(mapKey))
-			if isNil(mrv) {
-				// Don't write anything for nil fields.
+			v := index(mapKey)
+			if enc.filtered(key.Add(mapKey), v) {
+				continue
+			}
+			if enc.eDotted(key.Add(mapKey), v) {
 				continue
 			}
-			enc.encode(key.add(mapKey), mrv)
+			enc.encode(key.Add(mapKey), v)
 		}
 	}
-	writeMapKeys(mapKeysDirect)
-	writeMapKeys(mapKeysSub)
+	return func() { writeMapKeys(mapKeysDirect) },
+		func() { writeMapKeys(mapKeysSub) }
 }
 
-func (enc *Encoder) eStruct(key Key, rv reflect.Value) {
+// mapKeyStrings returns the keys of the map rv as they're written in TOML,
+// along with a function that returns the value of rv for one of those keys.
+//
+// Keys of a string kind are written as they are. Other keys are converted to
+// a string with their MarshalText method if they implement TextMarshaler,
+// with their String method if they implement fmt.Stringer, or as a decimal
+// number if they're integers. Like any other key, the converted keys are
+// quoted when written unless they're bare keys (e.g., a time.Time key is
+// written as "2014-05-06T07:08:09Z"). Any other key type panics with
+// errNonString, as do two keys that convert to the same string with
+// errDuplicateKey.
+func mapKeyStrings(rv reflect.Value) ([]string, func(string) reflect.Value) {
+	keyType := rv.Type().Key()
+	mapKeys := make([]string, 0, rv.Len())
+	if keyType.Kind() == reflect.String {
+		for _, mapKey := range rv.MapKeys() {
+			mapKeys = append(mapKeys, mapKey.String())
+		}
+		return mapKeys, func(k string) reflect.Value {
+			return rv.MapIndex(reflect.ValueOf(k).Convert(keyType))
+		}
+	}
+
+	var keyString func(reflect.Value) string
+	switch {
+	case keyType.Implements(textMarshalerType):
+		keyString = func(mapKey reflect.Value) string {
+			text, err := mapKey.Interface().(TextMarshaler).MarshalText()
+			if err != nil {
+				encPanic(err)
+			}
+			return string(text)
+		}
+	case keyType.Implements(stringerType):
+		keyString = func(mapKey reflect.Value) string {
+			return mapKey.Interface().(fmt.Stringer).String()
+		}
+	default:
+		switch keyType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64:
+			keyString = func(mapKey reflect.Value) string {
+				return strconv.FormatInt(mapKey.Int(), 10)
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+			reflect.Uint64:
+			keyString = func(mapKey reflect.Value) string {
+				return strconv.FormatUint(mapKey.Uint(), 10)
+			}
+		default:
+			encPanic(errNonString)
+		}
+	}
+
+	byString := make(map[string]reflect.Value, rv.Len())
+	for _, mapKey := range rv.MapKeys() {
+		k := keyString(mapKey)
+		if _, ok := byString[k]; ok {
+			encPanic(errDuplicateKey)
+		}
+		byString[k] = mapKey
+		mapKeys = append(mapKeys, k)
+	}
+	return mapKeys, func(k string) reflect.Value {
+		return rv.MapIndex(byString[k])
+	}
+}
+
+// sortMapKeys sorts the keys of the map with the key given, in the order in
+// which they're written.
+func (enc *Encoder) sortMapKeys(key Key, mapKeys []string) {
+	sort.Strings(mapKeys)
+	if enc.KeyCase != CaseNone {
+		sort.Sort(keyCaseOrder{mapKeys, enc.KeyCase})
+	}
+	if len(key) == 0 && len(enc.TopLevelKeyOrder) > 0 && !enc.Canonical {
+		sort.Sort(keyOrder{mapKeys, enc.TopLevelKeyOrder, enc.KeyCase})
+	}
+}
+
+// checkKeyCase panics with errDuplicateKey if KeyCase writes two different
+// names of keys in the table key as the same key, which TOML doesn't allow.
+func (enc *Encoder) checkKeyCase(key Key, names ...[]string) {
+	if enc.KeyCase == CaseNone {
+		return
+	}
+	seen := make(map[string]string)
+	for _, list := range names {
+		for _, name := range list {
+			written := enc.KeyCase.apply(name)
+			if other, ok := seen[written]; ok && other != name {
+				encPanic(e("%s: '%s'", errDuplicateKey,
+					key.Add(name).Format()))
+			}
+			seen[written] = name
+		}
+	}
+}
+
+// isPlainPrimitive reports whether all values of type t are written as a
+// TOML string, integer, float or boolean by eElement's handling of their
+// kind, with no special case (such as TextMarshaler or a type encoder)
+// applying to them. Such values are never nil and never tables.
+func (enc *Encoder) isPlainPrimitive(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Float32, reflect.Float64:
+	default:
+		return false
+	}
+	if _, ok := enc.encoders[t]; ok {
+		return false
+	}
+	typeEncoders.RLock()
+	_, registered := typeEncoders.m[t]
+	typeEncoders.RUnlock()
+	if registered {
+		return false
+	}
+	return !(t.Implements(textMarshalerType) && !enc.IgnoreTextMarshaler) &&
+		!t.Implements(tomlValuerType) &&
+		!(enc.EnumAsString && t.Implements(stringerType)) &&
+		!(enc.ErrorAsString && t.Implements(errorType))
+}
+
+var (
+	jsonNumberType    = reflect.TypeOf(json.Number(""))
+	textMarshalerType = reflect.TypeOf((*TextMarshaler)(nil)).Elem()
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ePrimitiveMap writes a map whose values are plain primitives (see
+// isPlainPrimitive). This is a faster version of eMap for such maps, which
+// are common: since none of the values can be tables or nil, they don't have
+// to be classified, and they can be written without going through encode's
+// special cases. The output must be the same as eMap's.
+func (enc *Encoder) ePrimitiveMap(key Key, rv reflect.Value) {
+	mapKeys, index := mapKeyStrings(rv)
+	enc.checkKeyCase(key, mapKeys)
+	enc.sortMapKeys(key, mapKeys)
+
+	for _, mapKey := range mapKeys {
+		k := key.Add(mapKey)
+		v := index(mapKey)
+		if enc.filtered(k, v) {
+			continue
+		}
+		func() {
+			defer enc.enter(k, v)()
+			enc.keyEqElement(k, v)
+		}()
+	}
+}
+
+// eStruct returns functions that write the fields of the struct rv that
+// aren't tables, and the fields that are, in that order.
+func (enc *Encoder) eStruct(key Key, rv reflect.Value) (direct, sub func()) {
 	// Write keys for fields directly under this key first, because if we write
 	// a field that creates a new table, then all keys under it will be in that
 	// table (not the one we're writing here).
 	rt := rv.Type()
 	var fieldsDirect, fieldsSub [][]int
-	var addFields func(rt reflect.Type, rv reflect.Value, start []int)
-	addFields = func(rt reflect.Type, rv reflect.Value, start []int) {
-		for i := 0; i < rt.NumField(); i++ {
-			f := rt.Field(i)
-			// skip unexporded fields
-			if f.PkgPath != "" {
+	// The fields of a nil embedded pointer aren't written at all, like those
+	// of other nil fields.
+	embed := func(index []int) bool {
+		return !enc.isNil(rv.FieldByIndex(index))
+	}
+	err := enc.walkFields(rt, nil, embed, func(index []int,
+		f reflect.StructField) {
+
+		frv := enc.nilDefault(rv.FieldByIndex(index))
+		if enc.isUnsupported(frv) {
+			return
+		}
+		if enc.collecting &&
+			!enc.classifiable(key.Add(enc.fieldName(f)), frv) {
+			return
+		}
+		if hasModifier(f.Tag, MOD_EMBEDDED_TOML) ||
+			enc.writeInline(key, f, frv) {
+			// Embedded documents are written as strings, and inline
+			// tables are written like other values.
+			fieldsDirect = append(fieldsDirect, index)
+		} else if enc.isDotted(key.Add(enc.fieldName(f)), frv) {
+			fieldsDirect = append(fieldsDirect, index)
+		} else if typeIsHash(enc.tomlTypeOfGo(frv)) ||
+			(enc.isNil(frv) && enc.isTableType(frv.Type())) {
+			// Nil tables are usually skipped, but may be written as a
+			// placeholder (see writeFields), so they go with the other
+			// tables.
+			fieldsSub = append(fieldsSub, index)
+		} else {
+			fieldsDirect = append(fieldsDirect, index)
+		}
+	})
+	if err != nil {
+		encPanic(err)
+	}
+	sortFields(key, rt, fieldsDirect)
+	sortFields(key, rt, fieldsSub)
+
+	// seen holds the keys written so far (after KeyCase), with the names
+	// they were written for, when checking for duplicates or for names that
+	// KeyCase writes the same. Otherwise, tables with the same key are
+	// merged.
+	var seen map[string]string
+	var merged map[int][]reflect.Value
+	if enc.DetectDuplicateKeys || enc.KeyCase != CaseNone {
+		seen = make(map[string]string)
+	}
+	if !enc.DetectDuplicateKeys {
+		fieldsSub, merged = enc.mergeTableFields(key, rv, fieldsSub)
+	}
+
+	var writeFields = func(fields [][]int, merged map[int][]reflect.Value) {
+		for i, fieldIndex := range fields {
+			sft := rt.FieldByIndex(fieldIndex)
+			// omitempty and omitzero apply to the field's own value, not to
+			// the default that's written in place of a nil one.
+			fv := rv.FieldByIndex(fieldIndex)
+			sf := enc.nilDefault(fv)
+
+			opts := getEncodeOptions(sft.Tag, enc.UseJSONTagFallback)
+			if opts.skip {
 				continue
 			}
-			frv := rv.Field(i)
-			if f.Anonymous {
-				frv := eindirect(frv)
-				t := frv.Type()
-				if t.Kind() != reflect.Struct {
-					encPanic(errAnonNonStruct)
+			keyName := sft.Name
+			if opts.name != "" {
+				keyName = opts.name
+			}
+			if enc.filtered(key.Add(keyName), sf) {
+				continue
+			}
+
+			// Don't write anything for nil or omitted fields, except that a
+			// table with a comment is written as a placeholder: just the
+			// comment and the table header.
+			comment := sft.Tag.Get("comment")
+			enc.text = nil
+			emptyText := false
+			if opts.omitempty && !enc.isNil(sf) {
+				emptyText, enc.text = enc.emptyText(sf)
+			}
+			placeholder := false
+			if enc.isNil(sf) ||
+				(opts.omitempty && (isEmpty(fv) || emptyText)) ||
+				(opts.omitzero && isZero(fv)) {
+				if comment == "" || !enc.isTableType(sft.Type) {
+					continue
 				}
-				addFields(t, frv, f.Index)
-			} else if typeIsHash(tomlTypeOfGo(frv)) {
-				fieldsSub = append(fieldsSub, append(start, f.Index...))
-			} else {
-				fieldsDirect = append(fieldsDirect, append(start, f.Index...))
+				placeholder = true
+			}
+			enc.comment = comment
+
+			var embedded bool
+			enc.modifier, embedded = enc.fieldModifiers(key.Add(keyName),
+				sft.Tag, sf.Type())
+
+			enc.asString = opts.asString
+			enc.timeLayout = enc.fieldTimeLayout(key.Add(keyName), sft.Tag)
+
+			if seen != nil {
+				written := enc.KeyCase.apply(keyName)
+				if name, ok := seen[written]; ok &&
+					(enc.DetectDuplicateKeys || name != keyName) {
+					encPanic(e("%s: '%s'", errDuplicateKey,
+						key.Add(keyName).Format()))
+				}
+				seen[written] = keyName
+			}
+			if placeholder {
+				enc.tableHeader(key.Add(keyName))
+				continue
+			}
+			if embedded {
+				enc.eEmbedded(key.Add(keyName), sf)
+				continue
+			}
+			if enc.writeInline(key, sft, sf) {
+				enc.keyEqElement(key.Add(keyName), eindirect(sf))
+				continue
+			}
+			if enc.eDotted(key.Add(keyName), sf) {
+				continue
+			}
+			if others := merged[i]; len(others) > 0 {
+				enc.eMergedTable(key.Add(keyName),
+					append([]reflect.Value{sf}, others...))
+				continue
+			}
+			enc.encode(key.Add(keyName), sf)
+		}
+	}
+	return func() { writeFields(fieldsDirect, nil) },
+		func() { writeFields(fieldsSub, merged) }
+}
+
+// fieldTimeLayout returns the layout in the `datetime` tag of the struct field
+// with the key given, which must produce a TOML datetime, date or time.
+func (enc *Encoder) fieldTimeLayout(key Key, tag reflect.StructTag) string {
+	layout := tag.Get("datetime")
+	if layout != "" && !isValidTimeLayout(layout, enc.Spec) {
+		encPanicKey(key, e("Datetime layout '%s' does not produce a TOML "+
+			"datetime, date or time (or, in TOML 0.4, an offset datetime).",
+			layout))
+	}
+	return layout
+}
+
+// mergeTableFields finds the fields of the struct rv (given by their indexes
+// in fields, the fields written as tables) that would be written as tables
+// with the same key, such as a field and a field of an embedded struct with
+// the same name given by a tag. All but the first of them are removed from
+// the fields returned, and their values are returned by the position of the
+// first one, so that they can be written as a single table.
+func (enc *Encoder) mergeTableFields(key Key, rv reflect.Value,
+	fields [][]int) ([][]int, map[int][]reflect.Value) {
+
+	rt := rv.Type()
+	names := make([]string, len(fields))
+	count := make(map[string]int, len(fields))
+	for i, fieldIndex := range fields {
+		sft := rt.FieldByIndex(fieldIndex)
+		opts := getEncodeOptions(sft.Tag, enc.UseJSONTagFallback)
+		if opts.skip {
+			continue
+		}
+		names[i] = sft.Name
+		if opts.name != "" {
+			names[i] = opts.name
+		}
+		count[names[i]]++
+	}
+
+	var kept [][]int
+	var merged map[int][]reflect.Value
+	first := make(map[string]int)
+	for i, fieldIndex := range fields {
+		name := names[i]
+		if count[name] < 2 || !enc.isWrittenTable(key.Add(name),
+			rt.FieldByIndex(fieldIndex), rv.FieldByIndex(fieldIndex)) {
+			kept = append(kept, fieldIndex)
+			continue
+		}
+		if p, ok := first[name]; ok {
+			if merged == nil {
+				merged = make(map[int][]reflect.Value)
 			}
+			merged[p] = append(merged[p], rv.FieldByIndex(fieldIndex))
+			continue
+		}
+		first[name] = len(kept)
+		kept = append(kept, fieldIndex)
+	}
+	return kept, merged
+}
+
+// isWrittenTable reports whether the struct field sft, with value rv, is
+// written as a table with the key given, and not left out.
+func (enc *Encoder) isWrittenTable(key Key, sft reflect.StructField,
+	rv reflect.Value) bool {
+
+	opts := getEncodeOptions(sft.Tag, enc.UseJSONTagFallback)
+	return !(opts.omitempty && isEmpty(rv)) &&
+		!(opts.omitzero && isZero(rv)) &&
+		!hasModifier(sft.Tag, MOD_EMBEDDED_TOML) &&
+		typeEqual(enc.tomlTypeOfGo(rv), tomlHash) &&
+		!enc.filtered(key, rv)
+}
+
+// keyOrder sorts keys by their position in order. Keys that aren't in order
+// come after those that are, in alphabetical order of how they're written
+// with the KeyCase c.
+type keyOrder struct {
+	keys  []string
+	order []string
+	c     KeyCase
+}
+
+func (x keyOrder) Len() int { return len(x.keys) }
+
+func (x keyOrder) Swap(i, j int) { x.keys[i], x.keys[j] = x.keys[j], x.keys[i] }
+
+func (x keyOrder) Less(i, j int) bool {
+	pi, pj := x.position(x.keys[i]), x.position(x.keys[j])
+	if pi != pj {
+		return pi < pj
+	}
+	return keyCaseOrder{x.keys, x.c}.Less(i, j)
+}
+
+func (x keyOrder) position(k string) int {
+	for i, o := range x.order {
+		if o == k {
+			return i
+		}
+	}
+	return len(x.order)
+}
+
+// keyCaseOrder sorts keys by how they're written with a KeyCase.
+type keyCaseOrder struct {
+	keys []string
+	c    KeyCase
+}
+
+func (x keyCaseOrder) Len() int { return len(x.keys) }
+
+func (x keyCaseOrder) Swap(i, j int) {
+	x.keys[i], x.keys[j] = x.keys[j], x.keys[i]
+}
+
+func (x keyCaseOrder) Less(i, j int) bool {
+	ki, kj := x.c.apply(x.keys[i]), x.c.apply(x.keys[j])
+	if ki != kj {
+		return ki < kj
+	}
+	return x.keys[i] < x.keys[j]
+}
+
+// caseKey returns key with the Encoder's KeyCase applied to every piece.
+func (enc *Encoder) caseKey(key Key) Key {
+	if enc.KeyCase == CaseNone {
+		return key
+	}
+	k := make(Key, len(key))
+	for i, piece := range key {
+		k[i] = enc.KeyCase.apply(piece)
+	}
+	return k
+}
+
+// sortFields sorts the fields (given by their index in rt) by their
+// `tomlorder` tag, in increasing order. Fields without the tag come after
+// those with it, and fields with the same order (or without it) keep their
+// declaration order.
+func sortFields(key Key, rt reflect.Type, fields [][]int) {
+	orders := make([]int, len(fields))
+	hasOrder := false
+	for i, fieldIndex := range fields {
+		sft := rt.FieldByIndex(fieldIndex)
+		tag := sft.Tag.Get("tomlorder")
+		if tag == "" {
+			orders[i] = -1
+			continue
+		}
+		order, err := strconv.Atoi(tag)
+		if err != nil || order < 0 {
+			encPanic(e("Invalid tomlorder '%s' of field '%s' in table '%s'; "+
+				"it must be a non-negative integer.", tag, sft.Name,
+				key.Format()))
 		}
+		orders[i] = order
+		hasOrder = true
 	}
-	addFields(rt, rv, nil)
+	if hasOrder {
+		sort.Sort(fieldOrder{fields, orders})
+	}
+}
 
-	var writeFields = func(fields [][]int) {
-		for _, fieldIndex := range fields {
-			sft := rt.FieldByIndex(fieldIndex)
-			sf := rv.FieldByIndex(fieldIndex)
-			if isNil(sf) {
-				// Don't write anything for nil fields.
-				continue
-			}
+// fieldOrder sorts fields by their tomlorder (-1 if they don't have one, which
+// sorts last), breaking ties by declaration order.
+type fieldOrder struct {
+	fields [][]int
+	orders []int
+}
 
-			keyName := sft.Tag.Get("toml")
-			if keyName == "-" {
-				continue
-			}
-			if keyName == "" {
-				keyName = sft.Name
-			}
+func (x fieldOrder) Len() int { return len(x.fields) }
 
-			keyModifier := Modifier(sft.Tag.Get("modifier"))
-			if kind, ok := validmodifiers[keyModifier]; ok && sf.Kind() == kind {
-				enc.modifier = keyModifier
-			} else {
-				enc.modifier = MOD_NONE
-			}
+func (x fieldOrder) Swap(i, j int) {
+	x.fields[i], x.fields[j] = x.fields[j], x.fields[i]
+	x.orders[i], x.orders[j] = x.orders[j], x.orders[i]
+}
 
-			enc.encode(key.add(keyName), sf)
+func (x fieldOrder) Less(i, j int) bool {
+	oi, oj := x.orders[i], x.orders[j]
+	if oi != oj {
+		return oj == -1 || (oi != -1 && oi < oj)
+	}
+	// Field indexes increase in declaration order, including the fields of
+	// embedded structs.
+	fi, fj := x.fields[i], x.fields[j]
+	for k := 0; k < len(fi) && k < len(fj); k++ {
+		if fi[k] != fj[k] {
+			return fi[k] < fj[k]
 		}
 	}
-	writeFields(fieldsDirect)
-	writeFields(fieldsSub)
+	return len(fi) < len(fj)
 }
 
 // tomlTypeName returns the TOML type name of the Go value's type. It is used to
@@ -380,12 +3290,34 @@ func (enc *Encoder) eStruct(key Key, rv reflect.Value) {
 
 // Returns the TOML type of a Go value. The type may be `nil`, which means
 // no concrete TOML type could be found.
-func tomlTypeOfGo(rv reflect.Value) tomlType {
-	if isNil(rv) || !rv.IsValid() {
+//
+// Pointers and interfaces are unwrapped, so that (for example) an interface{}
+// struct field holding a map is classified as a hash. eMap and eStruct rely
+// on this to write such fields after the keys of the enclosing table.
+func (enc *Encoder) tomlTypeOfGo(rv reflect.Value) tomlType {
+	if enc.isNil(rv) || !rv.IsValid() {
 		return nil
 	}
+	if _, _, ok := enc.typeEncoderFor(rv); ok {
+		return tomlString
+	}
+	if v, ok := enc.substituteValue(rv); ok {
+		return enc.tomlTypeOfGo(v)
+	}
+	if enc.isErrorString(rv) || enc.isEnumString(rv) {
+		return tomlString
+	}
+	if rv.Type() == jsonNumberType {
+		if isJSONFloat(json.Number(rv.String())) {
+			return tomlFloat
+		}
+		return tomlInteger
+	}
 	switch rv.Kind() {
 	case reflect.Bool:
+		if enc.BoolAsString != nil {
+			return tomlString
+		}
 		return tomlBool
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
 		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
@@ -393,14 +3325,17 @@ func tomlTypeOfGo(rv reflect.Value) tomlType {
 		return tomlInteger
 	case reflect.Float32, reflect.Float64:
 		return tomlFloat
+	case reflect.Complex64, reflect.Complex128:
+		// Complex numbers can only be written as strings (if at all).
+		return tomlString
 	case reflect.Array, reflect.Slice:
-		if typeEqual(tomlHash, tomlArrayType(rv)) {
+		if typeEqual(tomlHash, enc.tomlArrayType(rv)) {
 			return tomlArrayHash
 		} else {
 			return tomlArray
 		}
 	case reflect.Ptr, reflect.Interface:
-		return tomlTypeOfGo(rv.Elem())
+		return enc.tomlTypeOfGo(rv.Elem())
 	case reflect.String:
 		return tomlString
 	case reflect.Map:
@@ -409,13 +3344,19 @@ func tomlTypeOfGo(rv reflect.Value) tomlType {
 		switch rv.Interface().(type) {
 		case time.Time:
 			return tomlDatetime
-		case TextMarshaler:
+		case url.URL, Null:
 			return tomlString
-		default:
-			return tomlHash
 		}
+		if enc.isTextMarshaler(rv) {
+			return tomlString
+		}
+		return tomlHash
 	default:
-		panic("unexpected reflect.Kind: " + rv.Kind().String())
+		// Uintptrs, channels, functions and unsafe pointers have no TOML
+		// representation. Like complex numbers, they're classified as
+		// strings (since they aren't tables), so that the error for them
+		// from encode or eElement includes their key.
+		return tomlString
 	}
 }
 
@@ -424,30 +3365,44 @@ func tomlTypeOfGo(rv reflect.Value) tomlType {
 // slize). This function may also panic if it finds a type that cannot be
 // expressed in TOML (such as nil elements, heterogeneous arrays or directly
 // nested arrays of tables).
-func tomlArrayType(rv reflect.Value) tomlType {
-	if isNil(rv) || !rv.IsValid() || rv.Len() == 0 {
+func (enc *Encoder) tomlArrayType(rv reflect.Value) tomlType {
+	if enc.isNil(rv) || !rv.IsValid() || rv.Len() == 0 {
 		return nil
 	}
-	firstType := tomlTypeOfGo(rv.Index(0))
-	if firstType == nil {
-		encPanic(errArrayNilElement)
-	}
 
+	var firstType tomlType
+	var nested []int // the indexes of nested arrays
+	mixed := enc.AllowMixedArrays && enc.Spec >= TOML10
 	rvlen := rv.Len()
-	for i := 1; i < rvlen; i++ {
-		elem := rv.Index(i)
-		switch elemType := tomlTypeOfGo(elem); {
+	for i := 0; i < rvlen; i++ {
+		elemType := enc.tomlTypeOfGo(rv.Index(i))
+		switch {
 		case elemType == nil:
-			encPanic(errArrayNilElement)
+			if !enc.SkipNilArrayElements {
+				encPanic(arrayNilElementError{i})
+			}
+			continue
+		case firstType == nil:
+			firstType = elemType
 		case !typeEqual(firstType, elemType):
-			encPanic(errArrayMixedElementTypes)
+			// Tables can't be mixed with other values even when mixed
+			// arrays are allowed, since arrays of tables are written
+			// differently.
+			if !mixed || typeEqual(firstType, tomlHash) ||
+				typeEqual(elemType, tomlHash) {
+				encPanic(errArrayMixedElementTypes)
+			}
+		}
+		if typeEqual(elemType, tomlArray) || typeEqual(elemType, tomlArrayHash) {
+			nested = append(nested, i)
 		}
 	}
 	// If we have a nested array, then we must make sure that the nested
 	// array contains ONLY primitives.
-	// This checks arbitrarily nested arrays.
-	if typeEqual(firstType, tomlArray) || typeEqual(firstType, tomlArrayHash) {
-		nest := tomlArrayType(eindirect(rv.Index(0)))
+	// This checks arbitrarily nested arrays. Every nested array is checked,
+	// since with interface{} elements only some of them may contain tables.
+	for _, i := range nested {
+		nest := enc.tomlArrayType(eindirect(rv.Index(i)))
 		if typeEqual(nest, tomlHash) || typeEqual(nest, tomlArrayHash) {
 			encPanic(errArrayNoTable)
 		}
@@ -465,56 +3420,268 @@ func (enc *Encoder) keyEqElement(key Key, val reflect.Value) {
 	if len(key) == 0 {
 		encPanic(errNoKey)
 	}
-	panicIfInvalidKey(key, false)
-	enc.wf("%s%s = ", enc.indentStr(key), key[len(key)-1])
+	enc.panicIfInvalidKey(key, false)
+	table := key[:len(key)-enc.dotted]
+	name := enc.caseKey(key[len(table)-1:]).Format()
+	enc.dotted = 0
+	enc.writePendingComment(table)
+	enc.elementKey = key
+	enc.wf("%s%s", enc.indentStr(table), name)
+	if enc.aligning {
+		enc.marks = append(enc.marks, alignMark{
+			pos:   enc.written - enc.alignStart,
+			width: utf8.RuneCountInString(name),
+		})
+	}
+	enc.wf(enc.separator())
+	enc.stats.Keys++
+	if enc.OnKeyValue != nil {
+		enc.capture = new(bytes.Buffer)
+	}
+
+	if placeholder, ok := enc.RedactKeys[key.String()]; ok &&
+		!typeIsHash(enc.tomlTypeOfGo(val)) {
+		enc.writeQuoted(placeholder)
+		enc.reportKeyValue(key, val)
+		enc.newline()
+		enc.modifier = MOD_NONE
+		enc.text = nil
+		return
+	}
+
+	// The string option only applies to numbers and booleans, whose
+	// formatted values never need escaping. Runes written as strings by
+	// their modifier are already quoted.
+	quote := false
+	if enc.asString {
+		typ := enc.tomlTypeOfGo(val)
+		quote = enc.modifier != MOD_RUNE && enc.modifier != MOD_RUNES &&
+			(typeEqual(typ, tomlInteger) || typeEqual(typ, tomlFloat) ||
+				typeEqual(typ, tomlBool))
+		enc.asString = false
+	}
+	if quote {
+		enc.wf(`"`)
+	}
+	// A modifier applies to the value and, for arrays, to each of its
+	// elements, so it is only reset once the whole value has been written.
+	enc.eElement(val)
+	if quote {
+		enc.wf(`"`)
+	}
+	enc.reportKeyValue(key, val)
+	enc.newline()
+	enc.modifier = MOD_NONE
+	enc.text = nil
+}
+
+// reportKeyValue calls OnKeyValue with the value of key that was just written
+// by keyEqElement.
+func (enc *Encoder) reportKeyValue(key Key, val reflect.Value) {
+	if enc.capture == nil {
+		return
+	}
+	rendered := enc.capture.String()
+	enc.capture = nil
+	var typ tomlType = tomlString
+	if !strings.HasPrefix(rendered, `"`) && !strings.HasPrefix(rendered, "'") {
+		typ = enc.tomlTypeOfGo(val)
+	}
+	enc.OnKeyValue(key, typ.typeString(), rendered)
+}
+
+// writeJSONNumber writes n as a TOML float if it has a fraction or an
+// exponent, and as an integer otherwise. The zero json.Number ("") is written
+// as 0, as encoding/json does. Numbers that aren't valid, or that don't fit in
+// a float64 or int64, are an error.
+func (enc *Encoder) writeJSONNumber(n json.Number) {
+	if n == "" {
+		n = "0"
+	}
+	if isJSONFloat(n) {
+		f, err := strconv.ParseFloat(string(n), 64)
+		if err != nil {
+			encPanicKey(enc.elementKey, e("Invalid json.Number %q: %s",
+				string(n), err))
+		}
+		enc.writeFloat(f, 64)
+		return
+	}
+	i, err := strconv.ParseInt(string(n), 10, 64)
+	if err != nil {
+		encPanicKey(enc.elementKey, e("Invalid json.Number %q: %s",
+			string(n), err))
+	}
+	enc.wf(enc.signed(strconv.FormatInt(i, 10)))
+}
+
+// isJSONFloat reports whether n is written as a TOML float.
+func isJSONFloat(n json.Number) bool {
+	return strings.ContainsAny(string(n), ".eE")
+}
 
-	//a modifier exists on this element, handle it with the appropriate function
+// writeString writes a string element, respecting the active modifier.
+func (enc *Encoder) writeString(s string) {
 	switch enc.modifier {
 	case MOD_MULTILINE_STRING:
-		enc.writeMultiLineString(val.String(), false)
+		enc.writeMultiLineString(s, false)
 	case MOD_MULTILINE_RAWSTRING:
-		enc.writeMultiLineString(val.String(), true)
+		enc.writeMultiLineString(s, true)
 	default:
-		enc.eElement(val)
+		enc.writeQuoted(s)
 	}
-	enc.newline()
-	enc.modifier = MOD_NONE //re-setting the flag for safety. shoud not strictly be necessary
 }
 
 func (enc *Encoder) writeMultiLineString(s string, raw bool) {
-	//if there are any windows style CRLF terminations, replace them with newlines and then split
-	//s = strings.Replace(s, "\r\n", "\n", -1)
-	//lines := strings.Split(s, "\n")
-
 	var marker string
 	if raw {
 		marker = `'''`
+		if strings.Contains(s, marker) {
+			encPanic(e("Can't write %q as a multi-line raw string since it "+
+				"contains %s.", s, marker))
+		}
+	} else if enc.StringEscaper != nil {
+		marker = `"""`
+		lines := strings.Split(s, "\n")
+		for i, line := range lines {
+			lines[i] = enc.StringEscaper.Escape(line)
+		}
+		s = strings.Join(lines, "\n")
 	} else {
 		marker = `"""`
+		s = multilineReplacer.Replace(s)
 	}
 
-	enc.wf(marker) //triple quote to start multiline string
-	if raw {
-		enc.wf(s + " ")
-	} else {
-		enc.wf(quotedReplacer.Replace(s)) //quote the rest of the characters
-	}
-	enc.wf(marker)
+	// The newline immediately following the opening delimiter is trimmed
+	// when the string is read, so the content starts on its own line.
+	enc.wf("%s\n%s%s", marker, s, marker)
 }
 
 func (enc *Encoder) wf(format string, v ...interface{}) {
-	if _, err := fmt.Fprintf(enc.w, format, v...); err != nil {
-		encPanic(err)
+	s := fmt.Sprintf(format, v...)
+	end := len(s)
+	for end > 0 && s[end-1] == '\n' {
+		end--
+	}
+	if end > 0 {
+		if enc.newlines > 0 {
+			enc.write(strings.Repeat("\n", enc.newlines))
+			enc.newlines = 0
+		}
+		enc.write(s[:end])
 	}
+	enc.newlines += len(s) - end
 	enc.hasWritten = true
 }
 
+// write writes s to the output, enforcing MaxBytes.
+func (enc *Encoder) write(s string) {
+	if enc.MaxBytes > 0 && enc.written+len(s) > enc.MaxBytes {
+		encPanic(ErrMaxBytes)
+	}
+	n, err := enc.w.WriteString(s)
+	enc.written += n
+	if enc.capture != nil {
+		enc.capture.WriteString(s[:n])
+	}
+	if err != nil {
+		enc.writeErr = err
+		encPanic(err)
+	}
+}
+
+// writeNewlines writes the newlines held back at the end of a partial
+// document, unless that would exceed MaxBytes.
+func (enc *Encoder) writeNewlines() {
+	n := enc.newlines
+	enc.newlines = 0
+	if n > 0 && (enc.MaxBytes <= 0 || enc.written+n <= enc.MaxBytes) {
+		n, _ = enc.w.WriteString(strings.Repeat("\n", n))
+		enc.written += n
+	}
+}
+
+// endDocument writes the single newline that ends the document if
+// FinalNewline is set. Any other trailing newlines are dropped.
+func (enc *Encoder) endDocument() {
+	if enc.FinalNewline && enc.newlines > 0 {
+		enc.newlines = 0
+		enc.write("\n")
+	}
+}
+
+// checkContext aborts encoding with the context's error if the context given
+// to EncodeContext has been cancelled.
+func (enc *Encoder) checkContext() {
+	if enc.ctx == nil {
+		return
+	}
+	if err := enc.ctx.Err(); err != nil {
+		encPanic(err)
+	}
+}
+
+// indentStr returns the indentation of a line written for key: one level for
+// every table that contains it. A table header, [key] or [[key]], is written
+// at the indentation of key itself, and the keys inside the table are one
+// level deeper, since they have one more piece. This holds for arrays of
+// tables too: every element is written at the same depth, as the key of an
+// element doesn't include its index.
+//
+// BaseIndent is added to the levels of every key.
 func (enc *Encoder) indentStr(key Key) string {
-	return strings.Repeat(enc.Indent, len(key)-1)
+	levels := len(key) - 1
+	if enc.BaseIndent > 0 {
+		levels += enc.BaseIndent
+	}
+	if levels <= 0 {
+		return ""
+	}
+	return strings.Repeat(enc.indentUnit(), levels)
+}
+
+// indentUnit returns a single level of indentation.
+func (enc *Encoder) indentUnit() string {
+	if enc.Canonical {
+		return "  "
+	}
+	return enc.Indent
+}
+
+func isValidIndent(s string) bool {
+	for _, r := range s {
+		if r != ' ' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// separator returns the separator between keys and values.
+func (enc *Encoder) separator() string {
+	if enc.KeyValueSeparator == "" || enc.Canonical {
+		return " = "
+	}
+	return enc.KeyValueSeparator
+}
+
+// isValidSeparator reports whether s can be the KeyValueSeparator.
+func isValidSeparator(s string) bool {
+	if s == "" {
+		return true
+	}
+	i := strings.Index(s, "=")
+	return i >= 0 && isValidIndent(s[:i]) && isValidIndent(s[i+1:])
 }
 
 func encPanic(err error) {
-	panic(tomlEncodeError{err})
+	panic(tomlEncodeError{error: err})
+}
+
+// encPanicKey is encPanic for an error with the value of key, which is given
+// as the key of the EncodeError instead of the innermost table being written.
+func encPanicKey(key Key, err error) {
+	panic(tomlEncodeError{error: err, key: key, keySet: true})
 }
 
 func eindirect(v reflect.Value) reflect.Value {
@@ -526,46 +3693,512 @@ func eindirect(v reflect.Value) reflect.Value {
 	}
 }
 
-func isNil(rv reflect.Value) bool {
+// isNil reports whether rv is nil, and so isn't written. An interface holding
+// a nil pointer, map or slice (a "typed nil") is nil too, like a nil
+// interface.
+func (enc *Encoder) isNil(rv reflect.Value) bool {
 	switch rv.Kind() {
-	case reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
-		return rv.IsNil()
-	default:
+	case reflect.Interface:
+		return rv.IsNil() || enc.isNil(rv.Elem())
+	case reflect.Map, reflect.Ptr, reflect.Slice:
+		if rv.IsNil() {
+			return true
+		}
+	}
+	if v, ok := enc.substituteValue(rv); ok {
+		return !v.IsValid() || enc.isNil(v)
+	}
+	return false
+}
+
+// Null is a placeholder for a value that is explicitly null, as opposed to a
+// key that isn't there at all, e.g., an interface{} field holding Null{} or
+// the value returned by a TOMLValue method. TOML has no null, so a key with a
+// Null value is written with the Encoder's NullRepresentation as a string,
+// e.g., `key = ""`. This is only a convention: whatever reads the document
+// has to treat that string as null.
+type Null struct{}
+
+// TOMLValuer is implemented by types that are encoded as another Go value,
+// which is encoded as usual in their place, e.g., a Secret type whose
+// TOMLValue method returns "***". Unlike a TextMarshaler, the value returned
+// can be of any type, including a map or struct (which is written as a
+// table), and a nil value isn't written at all, like other nil values.
+//
+// TOMLValue is called once for each value during a call to Encode, and what
+// it returns is used wherever the value is needed (e.g., to find out whether
+// it's a table and then to write it). Equal values of a type that can be
+// compared with ==, such as a string type, count as the same value. Values
+// that can't be told apart, such as a struct with a slice field held in a
+// map, may have TOMLValue called more than once. To prevent infinite loops,
+// the value returned must not implement TOMLValuer itself.
+type TOMLValuer interface {
+	TOMLValue() interface{}
+}
+
+var tomlValuerType = reflect.TypeOf((*TOMLValuer)(nil)).Elem()
+
+// substituteValue reports whether rv is encoded as another value: the value
+// returned by its TOMLValue method if it implements TOMLValuer, a snapshot of
+// a sync.Map (see syncMapValue), the value a json.RawMessage holds (see
+// jsonRawMessageValue), or the value held by one of the Null types of
+// database/sql (see sqlNullValue). The zero Value is returned if the other
+// value is nil.
+func (enc *Encoder) substituteValue(rv reflect.Value) (reflect.Value,
+	bool) {
+	if !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return reflect.Value{}, false
+	}
+	if rv.Type() == syncMapType {
+		return enc.syncMapValue(rv), true
+	}
+	if rv.Type() == jsonRawMessageType {
+		v, err := enc.jsonRawMessageValue(rv)
+		if err != nil {
+			// Invalid JSON is reported by checkJSONRawMessage once the key
+			// is known; until then it's treated as a string.
+			return reflect.ValueOf(string(rv.Bytes())), true
+		}
+		return v, true
+	}
+	if !rv.CanInterface() || !rv.Type().Implements(tomlValuerType) {
+		return sqlNullValue(rv)
+	}
+	v, _ := enc.substitution(rv, func() (reflect.Value, error) {
+		v := reflect.ValueOf(rv.Interface().(TOMLValuer).TOMLValue())
+		if v.IsValid() && v.Type().Implements(tomlValuerType) {
+			encPanic(e("TOMLValue of %s returned a %s, which implements "+
+				"TOMLValuer too", rv.Type(), v.Type()))
+		}
+		return v, nil
+	})
+	return v, true
+}
+
+// substitute is a value that is encoded as another one, and that value (or
+// the error that prevented finding it).
+type substitute struct {
+	from, to reflect.Value
+	err      error
+}
+
+// substitution returns the value that rv is encoded as, which f returns. f
+// is only called the first time rv is substituted during a call to Encode;
+// what it returned is used after that. from is kept along with it, so that
+// its memory can't be reused for another value in the meantime.
+func (enc *Encoder) substitution(rv reflect.Value,
+	f func() (reflect.Value, error)) (reflect.Value, error) {
+
+	id, ok := valueID(rv)
+	if !ok {
+		return f()
+	}
+	if s, ok := enc.substitutes[id]; ok {
+		return s.to, s.err
+	}
+	v, err := f()
+	if enc.substitutes == nil {
+		enc.substitutes = make(map[interface{}]substitute)
+	}
+	enc.substitutes[id] = substitute{rv, v, err}
+	return v, err
+}
+
+// valueRef identifies a value by the memory it's in, for valueID.
+type valueRef struct {
+	ptr uintptr
+	len int
+	typ reflect.Type
+}
+
+// valueID returns a key that identifies the value rv for the duration of a
+// call to Encode, if it has one: the pointer, map or slice it is, its address,
+// or rv itself if values of its type can be compared (so that equal values
+// have the same key). Other values, such as a struct with a slice field held
+// in a map, can't be told apart.
+func valueID(rv reflect.Value) (interface{}, bool) {
+	switch {
+	case rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Map:
+		return valueRef{rv.Pointer(), 0, rv.Type()}, true
+	case rv.Kind() == reflect.Slice:
+		return valueRef{rv.Pointer(), rv.Len(), rv.Type()}, true
+	case rv.CanAddr():
+		return valueRef{rv.UnsafeAddr(), 0, rv.Type()}, true
+	case rv.CanInterface() && isComparable(rv.Type()):
+		return rv.Interface(), true
+	}
+	return nil, false
+}
+
+// isComparable reports whether values of type t can always be compared with
+// ==, and so used as map keys. Unlike Type.Comparable (which Go 1.1 doesn't
+// have), it's false for interfaces, which may hold values that can't be.
+func isComparable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Array:
+		return isComparable(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !isComparable(t.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	case reflect.Func, reflect.Interface, reflect.Map, reflect.Slice:
 		return false
 	}
+	return true
 }
 
-func panicIfInvalidKey(key Key, hash bool) {
-	if hash {
-		for _, k := range key {
-			if !isValidTableName(k) {
-				encPanic(e("Key '%s' is not a valid table name. Table names "+
-					"cannot contain '[', ']' or '.'.", key.String()))
+var syncMapType = reflect.TypeOf(sync.Map{})
+
+// syncMapValue returns a snapshot of the sync.Map rv, taken with its Range
+// method, as a map[string]interface{}, so that it's written like other maps
+// (with its keys sorted). Its keys must be strings (of any string type). The
+// snapshot is taken once during a call to Encode, the first time rv is
+// reached, so that its classification and the table written agree even if
+// the map changes in the meantime.
+//
+// Range needs a pointer, so a sync.Map that isn't addressable (e.g., in a
+// struct given to Encode by value rather than by pointer) is copied first.
+// Such a copy can't be told apart from other copies, so its snapshot is taken
+// every time it's reached.
+func (enc *Encoder) syncMapValue(rv reflect.Value) reflect.Value {
+	v, err := enc.substitution(rv, func() (reflect.Value, error) {
+		rv := rv
+		if !rv.CanAddr() {
+			c := reflect.New(rv.Type()).Elem()
+			c.Set(rv)
+			rv = c
+		}
+		m := make(map[string]interface{})
+		var err error
+		rv.Addr().Interface().(*sync.Map).Range(func(k, v interface{}) bool {
+			kv := reflect.ValueOf(k)
+			if kv.Kind() != reflect.String {
+				err = errNonString
+				return false
 			}
+			if _, ok := m[kv.String()]; ok {
+				err = errDuplicateKey
+				return false
+			}
+			m[kv.String()] = v
+			return true
+		})
+		return reflect.ValueOf(m), err
+	})
+	if err != nil {
+		encPanic(err)
+	}
+	return v
+}
+
+var jsonRawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// jsonRawMessageValue returns the JSON value held by the json.RawMessage rv,
+// decoded into an interface{} (with numbers as json.Number, so that integers
+// stay integers), so that it's written as the corresponding TOML value: an
+// object as a table, an array as an array, and so on. An empty RawMessage or
+// a JSON null is nil. rv is only decoded once during a call to Encode, the
+// first time it's classified or written.
+func (enc *Encoder) jsonRawMessageValue(rv reflect.Value) (reflect.Value,
+	error) {
+
+	return enc.substitution(rv, func() (reflect.Value, error) {
+		return decodeJSONRawMessage(rv)
+	})
+}
+
+// decodeJSONRawMessage decodes the json.RawMessage rv for jsonRawMessageValue.
+func decodeJSONRawMessage(rv reflect.Value) (reflect.Value, error) {
+	if rv.Len() == 0 {
+		return reflect.Value{}, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(rv.Bytes()))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return reflect.Value{}, e("invalid JSON in json.RawMessage: %s", err)
+	}
+	if dec.Decode(new(interface{})) != io.EOF {
+		return reflect.Value{}, e("invalid JSON in json.RawMessage: more " +
+			"than one value")
+	}
+	return reflect.ValueOf(v), nil
+}
+
+// checkJSONRawMessage returns an error if rv is a json.RawMessage that
+// doesn't hold valid JSON. It is called right before rv is written, so that
+// the error gives its key.
+func (enc *Encoder) checkJSONRawMessage(rv reflect.Value) {
+	if rv.IsValid() && rv.Type() == jsonRawMessageType {
+		if _, err := enc.jsonRawMessageValue(rv); err != nil {
+			encPanic(err)
 		}
-	} else {
-		if !isValidKeyName(key[len(key)-1]) {
-			encPanic(e("Key '%s' is not a name. Key names "+
-				"cannot contain whitespace.", key.String()))
+	}
+}
+
+// sqlNullTypes are the names of the Null types in database/sql, other than
+// the generic Null[T].
+var sqlNullTypes = map[string]bool{
+	"NullBool": true, "NullByte": true, "NullFloat64": true, "NullInt16": true,
+	"NullInt32": true, "NullInt64": true, "NullString": true, "NullTime": true,
+}
+
+// sqlNullValue reports whether rv is one of the Null types of database/sql
+// (such as sql.NullString). If it is, the value it holds is returned, or the
+// zero Value if it isn't Valid.
+//
+// These types are matched by name rather than with a generic check for
+// structs with a Valid field, so that other types are never mistaken for
+// them. All of them have the value as their first field, followed by Valid.
+func sqlNullValue(rv reflect.Value) (reflect.Value, bool) {
+	rt := rv.Type()
+	if rt.Kind() != reflect.Struct || rt.PkgPath() != "database/sql" ||
+		!(sqlNullTypes[rt.Name()] || strings.HasPrefix(rt.Name(), "Null[")) {
+		return reflect.Value{}, false
+	}
+	if !rv.Field(1).Bool() {
+		return reflect.Value{}, true
+	}
+	return rv.Field(0), true
+}
+
+// isTableType reports whether values of type t (or what it points to) are
+// encoded as tables.
+func (enc *Encoder) isTableType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return true
+	case reflect.Struct:
+		return typeIsHash(enc.tomlTypeOfGo(reflect.New(t).Elem()))
+	}
+	return false
+}
+
+// eEmbedded writes rv as a string holding a separate TOML document, for the
+// embedded_toml modifier. The document is written by a sub-encoder with the
+// same options as enc, except for Header, SchemaComment and BaseIndent (which
+// indents the enclosing document, not the string). Errors from the
+// sub-encoder are returned by Encode, prefixed with the key of the field
+// (ErrMaxDepth, ErrMaxBytes and errors of the context given to EncodeContext
+// are returned as they are).
+func (enc *Encoder) eEmbedded(key Key, rv reflect.Value) {
+	var buf bytes.Buffer
+	sub := *enc
+	sub.w = bufio.NewWriter(&buf)
+	sub.resetOutput()
+	sub.Header = ""
+	sub.SchemaComment = ""
+	sub.BaseIndent = 0
+	sub.OnKeyValue = nil
+	sub.collecting = false
+	if err := sub.safeEncode(NewKey(), rv); err != nil {
+		inner := err.(*EncodeError).Err
+		if inner == ErrMaxDepth || inner == ErrMaxBytes ||
+			(enc.ctx != nil && inner == enc.ctx.Err()) {
+			encPanic(inner)
 		}
+		encPanicKey(key, e("Could not encode embedded TOML: %s", err))
+	}
+	if err := sub.w.Flush(); err != nil {
+		encPanic(err)
 	}
+	enc.keyEqElement(key, reflect.ValueOf(buf.String()))
 }
 
-func isValidTableName(s string) bool {
-	if len(s) == 0 {
-		return false
+// hasModifier reports whether m is one of the modifiers in the `modifier` tag
+// of a struct field.
+func hasModifier(tag reflect.StructTag, m Modifier) bool {
+	for _, name := range strings.Split(tag.Get("modifier"), ",") {
+		if Modifier(name) == m {
+			return true
+		}
 	}
-	for _, r := range s {
-		if r == '[' || r == ']' || r == '.' {
-			return false
+	return false
+}
+
+// fieldModifiers returns the modifier to write the value of a struct field of
+// type t with, given its `modifier` tag, and whether it is written as embedded
+// TOML. The modifiers that are unknown or don't apply to t are ignored (or,
+// with StrictModifiers, are an error). MOD_EMBEDDED_TOML is applied first,
+// so the other modifiers apply to the document it produces, which is a
+// string. Two other modifiers that apply can't be combined, since each of
+// them changes how the value is represented.
+func (enc *Encoder) fieldModifiers(key Key, tag reflect.StructTag,
+	t reflect.Type) (Modifier, bool) {
+	names := strings.Split(tag.Get("modifier"), ",")
+	embedded := hasModifier(tag, MOD_EMBEDDED_TOML)
+	if embedded {
+		t = reflect.TypeOf("")
+	}
+	modifier := MOD_NONE
+	for _, name := range names {
+		m := Modifier(name)
+		kind, ok := validmodifiers[m]
+		switch {
+		case m == MOD_NONE && len(names) == 1, m == MOD_EMBEDDED_TOML:
+			continue
+		case !ok:
+			if enc.StrictModifiers {
+				encPanicKey(key, e("unknown modifier '%s'", m))
+			}
+			continue
+		case !modifierApplies(kind, t):
+			if enc.StrictModifiers {
+				encPanicKey(key, e("modifier '%s' doesn't apply to %s", m,
+					t))
+			}
+			continue
 		}
+		if modifier != MOD_NONE && modifier != m {
+			encPanicKey(key, e("modifiers '%s' and '%s' can't be combined",
+				modifier, m))
+		}
+		modifier = m
 	}
-	return true
+	return modifier, embedded
 }
 
-func isValidKeyName(s string) bool {
-	if len(s) == 0 {
-		return false
+// modifierApplies reports whether a modifier for values of the given kind can
+// be used for a field of type t. Modifiers also apply to the elements of
+// (possibly nested) arrays and slices.
+func modifierApplies(kind reflect.Kind, t reflect.Type) bool {
+	if kind == reflect.Invalid {
+		return true
+	}
+	for t.Kind() == reflect.Array || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t.Kind() == kind
+}
+
+// emptyText reports whether rv implements TextMarshaler and MarshalText
+// returns empty text, for OmitEmptyText. If the text isn't empty, it is
+// returned so that it can be written without calling MarshalText again.
+func (enc *Encoder) emptyText(rv reflect.Value) (bool, []byte) {
+	if !enc.OmitEmptyText || !rv.CanInterface() {
+		return false, nil
+	}
+	// Type encoders take precedence over MarshalText, and datetimes are
+	// never empty.
+	if _, _, ok := enc.typeEncoderFor(rv); ok {
+		return false, nil
+	}
+	switch v := rv.Interface().(type) {
+	case time.Time, *time.Time:
+		return false, nil
+	case TextMarshaler:
+		if enc.IgnoreTextMarshaler {
+			return false, nil
+		}
+		text, err := v.MarshalText()
+		if err != nil {
+			encPanic(err)
+		}
+		if len(text) == 0 {
+			return true, nil
+		}
+		return false, text
+	}
+	return false, nil
+}
+
+// IsZeroer is implemented by types with their own notion of emptiness for the
+// omitempty option, such as time.Time. A struct field with omitempty whose
+// value implements it is omitted when IsZero returns true.
+type IsZeroer interface {
+	IsZero() bool
+}
+
+// isEmpty reports whether rv is empty in the sense of the omitempty option:
+// IsZero returns true if it implements IsZeroer, and otherwise it is false,
+// 0, "", a nil pointer or interface, or an array, slice or map with no
+// elements.
+func isEmpty(rv reflect.Value) bool {
+	if rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return true
+		}
+	}
+	if !rv.CanInterface() {
+		return isEmptyValue(rv)
+	}
+	if z, ok := rv.Interface().(IsZeroer); ok {
+		return z.IsZero()
+	}
+	return isEmptyValue(rv)
+}
+
+// isEmptyValue is isEmpty for the kind of rv only, ignoring IsZeroer.
+func isEmptyValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// isZero reports whether rv is the zero value for its type, in the sense of
+// the omitzero option. Unlike isEmpty, an empty but non-nil slice or map is
+// not zero, while a struct whose fields are all zero is.
+func isZero(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if !isZero(rv.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			if !isZero(rv.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Map, reflect.Interface, reflect.Ptr,
+		reflect.Chan, reflect.Func:
+		return rv.IsNil()
+	case reflect.String:
+		return rv.Len() == 0
+	case reflect.Complex64, reflect.Complex128:
+		return rv.Complex() == 0
+	}
+	return isEmptyValue(rv)
+}
+
+// panicIfInvalidKey checks the pieces of key for StrictKeys: all of them for
+// a table (if hash is set), and only the last one otherwise. Any other piece
+// is valid, since pieces that can't be written bare (e.g., with whitespace,
+// '.' or brackets) are quoted.
+func (enc *Encoder) panicIfInvalidKey(key Key, hash bool) {
+	if !enc.StrictKeys {
+		return
+	}
+	pieces := key
+	if !hash && len(key) > 0 {
+		pieces = key[len(key)-1:]
+	}
+	for _, k := range pieces {
+		if strings.TrimSpace(k) == "" {
+			encPanic(e("%s: '%s'", errBlankKey, key.Format()))
+		}
 	}
-	return true
 }
@@ -0,0 +1,21 @@
+// +build go1.7
+
+package toml
+
+import (
+	"context"
+)
+
+// EncodeContext is just like Encode, except it periodically checks whether
+// ctx has been cancelled (at every key, array element and array of tables
+// element) and aborts with an *EncodeError wrapping ctx.Err() if it has.
+//
+// When encoding is aborted, some of the document may already have been
+// written to the underlying io.Writer while the rest remains unflushed in the
+// Encoder's buffer. The partial output is not a valid TOML document, and the
+// Encoder should not be used again after an aborted encode.
+func (enc *Encoder) EncodeContext(ctx context.Context, v interface{}) error {
+	enc.ctx = ctx
+	defer func() { enc.ctx = nil }()
+	return enc.Encode(v)
+}
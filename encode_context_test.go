@@ -0,0 +1,60 @@
+// +build go1.7
+
+package toml
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// countdownContext is a context that becomes cancelled after its Err method
+// has been called a fixed number of times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.n <= 0 {
+		return context.Canceled
+	}
+	ctx.n--
+	return nil
+}
+
+func TestEncodeContext(t *testing.T) {
+	val := map[string]interface{}{
+		"a": []int{1, 2, 3},
+		"b": []map[string]int{{"c": 1}, {"c": 2}},
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).EncodeContext(context.Background(), val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "a = [1, 2, 3]\n\n[[b]]\n  c = 1\n\n[[b]]\n  c = 2\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	buf.Reset()
+	err := NewEncoder(&buf).EncodeContext(ctx, val)
+	if underlying(err) != context.Canceled {
+		t.Errorf("want error %v, got %v", context.Canceled, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no output, got %q", buf.String())
+	}
+
+	for n := 0; n < 5; n++ {
+		ctx := &countdownContext{context.Background(), n}
+		err := NewEncoder(&buf).EncodeContext(ctx, val)
+		if underlying(err) != context.Canceled {
+			t.Errorf("cancelled after %d checks: want error %v, got %v",
+				n, context.Canceled, err)
+		}
+	}
+}
@@ -2,9 +2,19 @@ package toml
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -228,13 +238,13 @@ ArrayOfMixedSlices = [[1, 2], ["a", "b"]]
 		},
 		"(error) slice with 1 nil element": {
 			input:     struct{ NilElement1 []interface{} }{[]interface{}{nil}},
-			wantError: errArrayNilElement,
+			wantError: arrayNilElementError{0},
 		},
 		"(error) slice with 1 nil element (and other non-nil elements)": {
 			input: struct{ NilElement []interface{} }{
 				[]interface{}{1, nil},
 			},
-			wantError: errArrayNilElement,
+			wantError: arrayNilElementError{1},
 		},
 		"simple map": {
 			input:      map[string]int{"a": 1, "b": 2},
@@ -370,22 +380,22 @@ ArrayOfMixedSlices = [[1, 2], ["a", "b"]]
 			wantError: errArrayNoTable,
 		},
 		"(error) map no string key": {
-			input:     map[int]string{1: ""},
+			input:     map[float64]string{1: ""},
 			wantError: errNonString,
 		},
 		"(error) anonymous non-struct": {
 			input:     struct{ NonStruct }{5},
 			wantError: errAnonNonStruct,
 		},
-		"(error) empty key name": {
-			input:     map[string]int{"": 1},
-			wantError: errAnything,
+		"empty key name": {
+			input:      map[string]int{"": 1},
+			wantOutput: "\"\" = 1\n",
 		},
-		"(error) empty map name": {
+		"empty map name": {
 			input: map[string]interface{}{
 				"": map[string]int{"v": 1},
 			},
-			wantError: errAnything,
+			wantOutput: "[\"\"]\n  v = 1\n",
 		},
 		"multiline string": {
 			input: struct {
@@ -405,6 +415,211 @@ ArrayOfMixedSlices = [[1, 2], ["a", "b"]]
 	}
 }
 
+func TestEncodeMultilineStringSlice(t *testing.T) {
+	val := struct {
+		Lines []string `modifier:"multiline_string"`
+		Raw   []string `modifier:"multiline_rawstring"`
+		After []string
+	}{
+		[]string{"a\nb", "c"},
+		[]string{"C:\\path\nnext"},
+		[]string{"x\ny"},
+	}
+	expected := "Lines = [\"\"\"\na\nb\"\"\", \"\"\"\nc\"\"\"]\n" +
+		"Raw = ['''\nC:\\path\nnext''']\n" +
+		"After = [\"x\\ny\"]\n"
+	encodeExpected(t, "multiline string slice", val, expected, nil)
+}
+
+func TestEncodeRuneModifier(t *testing.T) {
+	type conf struct {
+		Sep     rune   `modifier:"rune"`
+		Seps    []rune `modifier:"rune"`
+		Code    rune
+		Quote   rune  `modifier:"rune" toml:",string"`
+		Count   int64 `modifier:"rune"`
+		Unicode rune  `modifier:"rune"`
+	}
+	val := conf{Sep: 'A', Seps: []rune{',', ';'}, Code: 'A', Quote: '"',
+		Count: 65, Unicode: 'é'}
+	expected := "Sep = \"A\"\nSeps = [\",\", \";\"]\nCode = 65\n" +
+		"Quote = \"\\\"\"\nCount = 65\nUnicode = \"é\"\n"
+	encodeExpected(t, "rune modifier", val, expected, nil)
+
+	encodeExpected(t, "invalid rune", conf{Sep: -1}, "", errAnything)
+}
+
+func TestEncodeRunesModifier(t *testing.T) {
+	type conf struct {
+		Name   []rune   `modifier:"runes"`
+		Fixed  [3]rune  `modifier:"runes"`
+		Lines  [][]rune `modifier:"runes"`
+		Sep    rune     `modifier:"runes"`
+		Empty  []rune   `modifier:"runes"`
+		Plain  []rune
+		Counts []int64 `modifier:"runes"`
+	}
+	val := conf{
+		Name:   []rune("café \"q\""),
+		Fixed:  [3]rune{'a', 'b', 'c'},
+		Lines:  [][]rune{[]rune("ab"), []rune("c")},
+		Sep:    ',',
+		Empty:  []rune{},
+		Plain:  []rune("hi"),
+		Counts: []int64{1},
+	}
+	expected := `Name = "café \"q\""
+Fixed = "abc"
+Lines = ["ab", "c"]
+Sep = ","
+Empty = ""
+Plain = [104, 105]
+Counts = [1]
+`
+	encodeExpected(t, "runes modifier", val, expected, nil)
+
+	encodeExpected(t, "invalid rune", conf{Name: []rune{'a', -1}}, "",
+		errAnything)
+}
+
+func TestEncodeStrictModifiers(t *testing.T) {
+	type mismatched struct {
+		Port int `modifier:"multiline_string"`
+	}
+	type unknown struct {
+		Text string `modifier:"multiline"`
+	}
+	type valid struct {
+		Text  string   `modifier:"multiline_string"`
+		Chars []rune   `modifier:"runes"`
+		Doc   struct{} `modifier:"embedded_toml"`
+	}
+
+	encodeExpected(t, "mismatched", mismatched{8080}, "Port = 8080\n", nil)
+	encodeExpected(t, "unknown", unknown{"a"}, "Text = \"a\"\n", nil)
+
+	for _, test := range []struct {
+		label string
+		val   interface{}
+		err   string
+	}{
+		{"mismatched", mismatched{8080},
+			"modifier 'multiline_string' doesn't apply to int (key 'Port',"},
+		{"unknown", unknown{"a"}, "unknown modifier 'multiline' (key 'Text',"},
+		{"valid", valid{"a", []rune("b"), struct{}{}}, ""},
+	} {
+		enc := NewEncoder(ioutil.Discard)
+		enc.StrictModifiers = true
+		err := enc.Encode(test.val)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: Encode failed: %s", test.label, err)
+		case test.err != "" &&
+			(err == nil || !strings.HasPrefix(err.Error(), test.err)):
+			t.Errorf("%s: want error %q, got %v", test.label, test.err, err)
+		}
+	}
+}
+
+func TestEncodeMultipleModifiers(t *testing.T) {
+	type plugin struct {
+		Name string
+		Port int
+	}
+	type conf struct {
+		Plugin plugin `modifier:"embedded_toml,multiline_string"`
+		Raw    plugin `modifier:"multiline_rawstring,embedded_toml"`
+	}
+	val := conf{Plugin: plugin{"a", 1}, Raw: plugin{"b\\", 2}}
+	encodeExpected(t, "embedded and multiline", val, `Plugin = """
+Name = \"a\"
+Port = 1
+"""
+Raw = '''
+Name = "b\\"
+Port = 2
+'''
+`, nil)
+
+	type conflicting struct {
+		Text string `modifier:"multiline_string,multiline_rawstring"`
+	}
+	type runes struct {
+		Chars []rune `modifier:"runes,rune"`
+	}
+	type duplicate struct {
+		Text string `modifier:"multiline_string,multiline_string"`
+	}
+	encodeExpected(t, "conflicting strings", conflicting{"a"}, "", errAnything)
+	encodeExpected(t, "conflicting runes", runes{[]rune("a")}, "",
+		errAnything)
+	encodeExpected(t, "duplicate", duplicate{"a"}, "Text = \"\"\"\na\"\"\"\n",
+		nil)
+
+	// Modifiers that don't apply are ignored, unless StrictModifiers is set.
+	type partial struct {
+		Text string `modifier:"multiline_string,rune"`
+	}
+	encodeExpected(t, "partial", partial{"a"}, "Text = \"\"\"\na\"\"\"\n", nil)
+	enc := NewEncoder(ioutil.Discard)
+	enc.StrictModifiers = true
+	if err := enc.Encode(partial{"a"}); err == nil {
+		t.Errorf("partial: expected error with StrictModifiers")
+	}
+}
+
+// encodeASCIIEscaper escapes everything but printable ASCII characters with
+// \uXXXX escapes in upper case.
+type encodeASCIIEscaper struct{}
+
+func (encodeASCIIEscaper) Escape(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fmt.Fprintf(&buf, "\\u%04X", r)
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+func TestEncodeStringEscaper(t *testing.T) {
+	val := struct {
+		Name  string
+		Lines string `modifier:"multiline_string"`
+		Tags  []string
+	}{"café \"q\"\t", "é\nb\\", []string{"ü"}}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.StringEscaper = encodeASCIIEscaper{}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Name = "caf\u00E9 \u0022q\u0022\u0009"
+Lines = """
+\u00E9
+b\u005C"""
+Tags = ["\u00FC"]
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	var decoded struct {
+		Name string
+		Tags []string
+	}
+	if _, err := Decode(expected, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != val.Name || decoded.Tags[0] != val.Tags[0] {
+		t.Errorf("want %q and %q decoded, got %q and %q", val.Name,
+			val.Tags[0], decoded.Name, decoded.Tags[0])
+	}
+}
+
 func TestEncodeNestedTableArrays(t *testing.T) {
 	type song struct {
 		Name string `toml:"name"`
@@ -445,6 +660,332 @@ func TestEncodeNestedTableArrays(t *testing.T) {
 	encodeExpected(t, "nested table arrays", value, expected, nil)
 }
 
+func TestEncodeMapOfTableArrays(t *testing.T) {
+	type server struct {
+		Name string `toml:"name"`
+		Port int    `toml:"port"`
+	}
+	val := map[string]interface{}{
+		"clusters": map[string]interface{}{
+			"east": []server{{"a", 1}, {"b", 2}},
+			"west": []server{{"c", 3}},
+			"zone": "eu",
+		},
+		"servers": map[string][]server{"s": {{"d", 4}}},
+		"version": 1,
+	}
+	expected := `version = 1
+
+[clusters]
+  zone = "eu"
+
+  [[clusters.east]]
+    name = "a"
+    port = 1
+
+  [[clusters.east]]
+    name = "b"
+    port = 2
+
+  [[clusters.west]]
+    name = "c"
+    port = 3
+
+[servers]
+
+  [[servers.s]]
+    name = "d"
+    port = 4
+`
+	encodeExpected(t, "map of arrays of tables", val, expected, nil)
+
+	var decoded map[string]interface{}
+	if _, err := Decode(expected, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	east := decoded["clusters"].(map[string]interface{})["east"]
+	if n := len(east.([]map[string]interface{})); n != 2 {
+		t.Errorf("want 2 east servers, got %d", n)
+	}
+}
+
+func TestEncodeMapOfTableArraysQuotedKeys(t *testing.T) {
+	type server struct {
+		Name string `toml:"name"`
+	}
+	servers := map[string][]server{
+		"east":       {{"a"}, {"b"}},
+		"west coast": {{"c"}},
+		"eu.1":       {{"d"}},
+		"[x]":        {{"e"}},
+	}
+	expected := `[["[x]"]]
+  name = "e"
+
+[[east]]
+  name = "a"
+
+[[east]]
+  name = "b"
+
+[["eu.1"]]
+  name = "d"
+
+[["west coast"]]
+  name = "c"
+`
+	encodeExpected(t, "quoted array of tables keys", servers, expected, nil)
+
+	expected = `[dc]
+
+  [[dc."west coast"]]
+    name = "c"
+`
+	encodeExpected(t, "quoted keys under a table", map[string]interface{}{
+		"dc": map[string]interface{}{
+			"west coast": []server{{"c"}},
+		},
+	}, expected, nil)
+	encodeExpected(t, "quoted table keys", map[string]interface{}{
+		"dc": map[string]interface{}{
+			"west coast": map[string]interface{}{
+				"meta": map[string]int{"a b": 1},
+			},
+		},
+	}, "[dc]\n  [dc.\"west coast\"]\n    [dc.\"west coast\".meta]\n"+
+		"      \"a b\" = 1\n", nil)
+}
+
+func TestEncodeTableArrayDifferentShapes(t *testing.T) {
+	// The elements of an array of tables only need to be tables: their keys
+	// and the types of their values may differ.
+	val := map[string]interface{}{
+		"p": []map[string]interface{}{
+			{"a": 1, "s": []int{1}},
+			{"a": "x", "b": map[string]int{"c": 1}},
+			{},
+		},
+		"q": []interface{}{
+			map[string]interface{}{"a": 1.5},
+			map[string]string{"a": "y"},
+		},
+	}
+	expected := `[[p]]
+  a = 1
+  s = [1]
+
+[[p]]
+  a = "x"
+  [p.b]
+    c = 1
+
+[[p]]
+
+[[q]]
+  a = 1.5
+
+[[q]]
+  a = "y"
+`
+	encodeExpected(t, "tables with different shapes", val, expected, nil)
+}
+
+func TestEncodeNestedTableArraysUnderTable(t *testing.T) {
+	type part struct {
+		Serial string `toml:"serial"`
+	}
+	type disk struct {
+		Size  int    `toml:"size"`
+		Parts []part `toml:"parts"`
+	}
+	type server struct {
+		Name  string `toml:"name"`
+		Disks []disk `toml:"disks"`
+	}
+
+	twoLevels := struct {
+		Servers server `toml:"servers"`
+	}{server{"alpha", []disk{{Size: 1}, {Size: 2}}}}
+	expected := `[servers]
+  name = "alpha"
+
+  [[servers.disks]]
+    size = 1
+
+  [[servers.disks]]
+    size = 2
+`
+	encodeExpected(t, "array of tables under a table", twoLevels, expected, nil)
+
+	threeLevels := struct {
+		Servers []server `toml:"servers"`
+	}{[]server{
+		{"alpha", []disk{
+			{1, []part{{"a1"}, {"a2"}}},
+			{2, nil},
+		}},
+		{"beta", []disk{
+			{3, []part{{"b1"}}},
+		}},
+	}}
+	expected = `[[servers]]
+  name = "alpha"
+
+  [[servers.disks]]
+    size = 1
+
+    [[servers.disks.parts]]
+      serial = "a1"
+
+    [[servers.disks.parts]]
+      serial = "a2"
+
+  [[servers.disks]]
+    size = 2
+
+[[servers]]
+  name = "beta"
+
+  [[servers.disks]]
+    size = 3
+
+    [[servers.disks.parts]]
+      serial = "b1"
+`
+	encodeExpected(t, "three levels of arrays of tables", threeLevels,
+		expected, nil)
+}
+
+func TestEncodeTableArrayIndent(t *testing.T) {
+	type leaf struct {
+		Z    int   `toml:"z"`
+		List []int `toml:"list"`
+	}
+	type mid struct {
+		Y      int    `toml:"y"`
+		Leaves []leaf `toml:"leaves" comment:"leaf tables"`
+	}
+	type top struct {
+		X    int   `toml:"x"`
+		Mids []mid `toml:"mids"`
+	}
+	tests := map[string]struct {
+		input      interface{}
+		wantOutput string
+	}{
+		"depth 1": {
+			input: struct {
+				Tops []leaf `toml:"tops"`
+			}{[]leaf{{Z: 1}, {Z: 2, List: []int{1, 2}}}},
+			wantOutput: "[[tops]]\n\tz = 1\n\n[[tops]]\n\tz = 2\n" +
+				"\tlist = [\n\t\t1,\n\t\t2\n\t]\n",
+		},
+		"depth 2": {
+			input: struct {
+				Tops []mid `toml:"tops"`
+			}{[]mid{{Y: 1, Leaves: []leaf{{Z: 2}, {Z: 3}}}}},
+			wantOutput: "[[tops]]\n\ty = 1\n\n" +
+				"\t# leaf tables\n\t[[tops.leaves]]\n\t\tz = 2\n\n" +
+				"\t[[tops.leaves]]\n\t\tz = 3\n",
+		},
+		"depth 3": {
+			input: struct {
+				Tops []top `toml:"tops"`
+			}{[]top{{X: 1, Mids: []mid{{Y: 2, Leaves: []leaf{
+				{Z: 3, List: []int{4}},
+			}}}}}},
+			wantOutput: "[[tops]]\n\tx = 1\n\n" +
+				"\t[[tops.mids]]\n\t\ty = 2\n\n" +
+				"\t\t# leaf tables\n\t\t[[tops.mids.leaves]]\n\t\t\tz = 3\n" +
+				"\t\t\tlist = [\n\t\t\t\t4\n\t\t\t]\n",
+		},
+	}
+	for label, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.Indent = "\t"
+		enc.ArrayStyle = ArrayExpanded
+		if err := enc.Encode(test.input); err != nil {
+			t.Errorf("%s: %s", label, err)
+			continue
+		}
+		if got := buf.String(); got != test.wantOutput {
+			t.Errorf("%s: want\n%q\nbut got\n%q", label, test.wantOutput, got)
+		}
+	}
+}
+
+func TestEncodeTableArraySeparation(t *testing.T) {
+	type server struct {
+		Name string `toml:"name"`
+	}
+	type cluster struct {
+		Region  string   `toml:"region"`
+		Servers []server `toml:"servers"`
+		Zones   []string `toml:"zones"`
+	}
+	val := struct {
+		Version  int       `toml:"version"`
+		Clusters []cluster `toml:"clusters"`
+		Cluster  cluster   `toml:"cluster"`
+	}{
+		Version:  1,
+		Clusters: []cluster{{Region: "eu", Servers: []server{{"a"}}}},
+		Cluster: cluster{Region: "us", Servers: []server{{"b"}, {"c"}},
+			Zones: []string{"x"}},
+	}
+	// Every element of an array of tables, including the first one in a
+	// table, is separated from what comes before it by a blank line.
+	expected := `version = 1
+
+[[clusters]]
+  region = "eu"
+
+  [[clusters.servers]]
+    name = "a"
+
+[cluster]
+  region = "us"
+  zones = ["x"]
+
+  [[cluster.servers]]
+    name = "b"
+
+  [[cluster.servers]]
+    name = "c"
+`
+	encodeExpected(t, "array of tables separation", val, expected, nil)
+}
+
+func TestEncodeFixedSizeArrayOfTables(t *testing.T) {
+	type server struct {
+		Name string `toml:"name,omitempty"`
+	}
+	expected := `[[servers]]
+  name = "a"
+
+[[servers]]
+
+[[servers]]
+  name = "c"
+`
+	array := struct {
+		Servers [3]server `toml:"servers"`
+	}{[3]server{{"a"}, {}, {"c"}}}
+	slice := struct {
+		Servers []server `toml:"servers"`
+	}{array.Servers[:]}
+	encodeExpected(t, "fixed-size array of tables", array, expected, nil)
+	encodeExpected(t, "slice of tables", slice, expected, nil)
+
+	// Nil elements are skipped, but zero-value structs aren't.
+	pointers := struct {
+		Servers [3]*server `toml:"servers"`
+	}{[3]*server{{"a"}, {}, {"c"}}}
+	encodeExpected(t, "fixed-size array of pointers to tables", pointers,
+		expected, nil)
+}
+
 func TestEncodeArrayHashWithNormalHashOrder(t *testing.T) {
 	type Alpha struct {
 		V int
@@ -467,29 +1008,4021 @@ func TestEncodeArrayHashWithNormalHashOrder(t *testing.T) {
 	encodeExpected(t, "array hash with normal hash order", val, expected, nil)
 }
 
-func encodeExpected(
-	t *testing.T, label string, val interface{}, wantStr string, wantErr error,
-) {
+func TestEncodeInterfaceTables(t *testing.T) {
+	type Conf struct {
+		Extra   interface{}
+		Pointer interface{}
+		Name    string
+		Empty   interface{}
+	}
+	val := Conf{
+		Extra: map[string]interface{}{
+			"sub": map[string]interface{}{"b": 2},
+			"a":   1,
+			"subs": []interface{}{
+				map[string]interface{}{"c": 3},
+			},
+		},
+		Pointer: &struct{ V int }{4},
+		Name:    "x",
+	}
+	expected := `Name = "x"
+
+[Extra]
+  a = 1
+  [Extra.sub]
+    b = 2
+
+  [[Extra.subs]]
+    c = 3
+
+[Pointer]
+  V = 4
+`
+	encodeExpected(t, "interface fields holding tables", val, expected, nil)
+
+	m := map[string]interface{}{
+		"table":  map[string]interface{}{"k": "v"},
+		"scalar": 1,
+		"array":  []interface{}{1, 2},
+		"time":   time.Date(2014, 5, 11, 19, 30, 40, 0, time.UTC),
+	}
+	expected = "array = [1, 2]\nscalar = 1\ntime = 2014-05-11T19:30:40Z\n" +
+		"\n[table]\n  k = \"v\"\n"
+	encodeExpected(t, "map with mixed interface values", m, expected, nil)
+}
+
+func TestMarshalTo(t *testing.T) {
+	var buf bytes.Buffer
+	val := map[string]interface{}{"a": 1, "t": map[string]int{"b": 2}}
+	if err := MarshalTo(&buf, val); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a = 1\n\n[t]\n  b = 2\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if err := MarshalTo(&buf, 1); underlying(err) != errNoKey {
+		t.Errorf("want error %v, got %v", errNoKey, err)
+	}
+}
+
+func TestEncodeReflectValue(t *testing.T) {
+	type conf struct {
+		Name  string
+		Table map[string]int
+	}
+	val := conf{"x", map[string]int{"a": 1}}
+	expected := "Name = \"x\"\n\n[Table]\n  a = 1\n"
+	rv := reflect.ValueOf(val)
+	encodeExpected(t, "reflect.Value", rv, expected, nil)
+	encodeExpected(t, "*reflect.Value", &rv, expected, nil)
+	encodeExpected(t, "reflect.Value of pointer", reflect.ValueOf(&val),
+		expected, nil)
+	encodeExpected(t, "reflect.Value of interface",
+		reflect.ValueOf([]interface{}{val}).Index(0), expected, nil)
+
+	encodeExpected(t, "zero reflect.Value", reflect.Value{}, "", errNoKey)
+	encodeExpected(t, "nil", nil, "", errNoKey)
+}
+
+func TestEncodeFieldOrder(t *testing.T) {
+	type table struct{ V int }
+	type Embedded struct {
+		E1 int
+		E2 int `tomlorder:"2"`
+	}
+	type conf struct {
+		A int `tomlorder:"3"`
+		B int
+		Embedded
+		C  int   `tomlorder:"1"`
+		D  int   `tomlorder:"2"`
+		T1 table `tomlorder:"1"`
+		T2 table
+		T3 table `tomlorder:"0"`
+	}
+	expected := `C = 0
+E2 = 0
+D = 0
+A = 0
+B = 0
+E1 = 0
+
+[T3]
+  V = 0
+
+[T1]
+  V = 0
+
+[T2]
+  V = 0
+`
+	encodeExpected(t, "tomlorder", conf{}, expected, nil)
+
+	encodeExpected(t, "invalid tomlorder", struct {
+		A int `tomlorder:"first"`
+	}{}, "", errAnything)
+}
+
+func TestEncodeFieldFilter(t *testing.T) {
+	type server struct {
+		Host     string
+		Password string
+	}
+	type conf struct {
+		Token   string
+		Server  server
+		Secrets map[string]string
+		Users   []map[string]string
+		Extra   map[string]interface{}
+	}
+	val := conf{
+		Token:   "t",
+		Server:  server{"localhost", "p"},
+		Secrets: map[string]string{"a": "b"},
+		Users:   []map[string]string{{"name": "x"}, {"name": "root"}},
+		Extra: map[string]interface{}{
+			"password": "p",
+			"keep":     1,
+		},
+	}
+
+	var paths []string
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
-	err := enc.Encode(val)
-	if err != wantErr {
-		if wantErr != nil {
-			if wantErr == errAnything && err != nil {
-				return
-			}
-			t.Errorf("%s: want Encode error %v, got %v", label, wantErr, err)
-		} else {
-			t.Errorf("%s: Encode failed: %s", label, err)
+	enc.FieldFilter = func(key Key, v reflect.Value) bool {
+		paths = append(paths, key.String())
+		switch strings.ToLower(key[len(key)-1]) {
+		case "token", "password", "secrets":
+			return false
 		}
+		if m, ok := v.Interface().(map[string]string); ok {
+			return m["name"] != "root"
+		}
+		return true
 	}
-	if err != nil {
-		return
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
 	}
-	if got := buf.String(); wantStr != got {
-		t.Errorf("%s: want\n-----\n%q\n-----\nbut got\n-----\n%q\n-----\n",
-			label, wantStr, got)
+	expected := `[Server]
+  Host = "localhost"
+
+[[Users]]
+  name = "x"
+
+[Extra]
+  keep = 1
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+	for _, p := range []string{"Server.Host", "Extra.password", "Users.name"} {
+		found := false
+		for _, path := range paths {
+			found = found || path == p
+		}
+		if !found {
+			t.Errorf("filter not called for %s; called for %v", p, paths)
+		}
+	}
+}
+
+func TestEncodeRedactKeys(t *testing.T) {
+	val := map[string]interface{}{
+		"database": map[string]interface{}{
+			"user":     "admin",
+			"password": "hunter2",
+			"port":     5432,
+			"keys":     []int{1, 2},
+		},
+		"password": map[string]string{"a": "b"},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.RedactKeys = map[string]string{
+		"database.password": "***",
+		"database.port":     "<port>",
+		"database.keys":     "",
+		"password":          "***",
+	}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+[database]
+  keys = ""
+  password = "***"
+  port = "<port>"
+  user = "admin"
+
+[password]
+  a = "b"
+`[1:]
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+func TestEncodeOmit(t *testing.T) {
+	type inner struct{ V int }
+	type conf struct {
+		ZeroInt    int            `toml:"zero_int,omitzero"`
+		EmptyInt   int            `toml:"empty_int,omitempty"`
+		Int        int            `toml:"int,omitzero"`
+		NilSlice   []int          `toml:"nil_slice,omitzero"`
+		EmptySlice []int          `toml:"empty_slice,omitzero"`
+		OmitSlice  []int          `toml:"omit_slice,omitempty"`
+		Both       []int          `toml:"both,omitempty,omitzero"`
+		ZeroStruct inner          `toml:"zero_struct,omitzero"`
+		Struct     inner          `toml:"struct,omitempty"`
+		EmptyMap   map[string]int `toml:",omitzero"`
+	}
+	expected := "int = 1\nempty_slice = []\n\n[struct]\n  V = 0\n\n[EmptyMap]\n"
+	encodeExpected(t, "omitempty and omitzero", conf{
+		Int:        1,
+		EmptySlice: []int{},
+		OmitSlice:  []int{},
+		Both:       []int{},
+		EmptyMap:   map[string]int{},
+	}, expected, nil)
+}
+
+type encodeMoney struct {
+	Cents    int64
+	Currency string
+}
+
+func (m encodeMoney) IsZero() bool { return m.Cents == 0 }
+
+func TestEncodeOmitEmptyIsZeroer(t *testing.T) {
+	type conf struct {
+		Price    encodeMoney  `toml:"price,omitempty"`
+		Discount encodeMoney  `toml:"discount,omitempty"`
+		Fee      encodeMoney  `toml:"fee"`
+		Tip      *encodeMoney `toml:"tip,omitempty"`
+		Updated  time.Time    `toml:"updated,omitempty"`
+		Created  time.Time    `toml:"created"`
+	}
+	val := conf{
+		Price:    encodeMoney{150, "EUR"},
+		Discount: encodeMoney{0, "EUR"},
+		Tip:      &encodeMoney{0, "EUR"},
+	}
+	expected := "created = 0001-01-01T00:00:00Z\n\n" +
+		"[price]\n  Cents = 150\n  Currency = \"EUR\"\n\n" +
+		"[fee]\n  Cents = 0\n  Currency = \"\"\n"
+	encodeExpected(t, "IsZeroer with omitempty", val, expected, nil)
+}
+
+// encodeID is written as "" when it is zero. encodeIDCalls counts the calls
+// to its MarshalText method.
+type encodeID struct{ n int }
+
+var encodeIDCalls int
+
+func (id encodeID) MarshalText() ([]byte, error) {
+	encodeIDCalls++
+	if id.n == 0 {
+		return nil, nil
+	}
+	return []byte(fmt.Sprintf("id-%d", id.n)), nil
+}
+
+func TestEncodeOmitEmptyText(t *testing.T) {
+	type conf struct {
+		ID     encodeID  `toml:"id,omitempty"`
+		Parent encodeID  `toml:"parent,omitempty"`
+		Ptr    *encodeID `toml:"ptr,omitempty"`
+		Always encodeID  `toml:"always"`
+		Inline struct {
+			ID    encodeID `toml:"id,omitempty"`
+			Other encodeID `toml:"other,omitempty"`
+		} `toml:"inline,inline"`
 	}
+	val := conf{ID: encodeID{1}, Ptr: &encodeID{}}
+	val.Inline.Other = encodeID{2}
+
+	encodeExpected(t, "without OmitEmptyText", val,
+		"id = \"id-1\"\nparent = \"\"\nptr = \"\"\nalways = \"\"\n"+
+			"inline = { id = \"\", other = \"id-2\" }\n", nil)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.OmitEmptyText = true
+	encodeIDCalls = 0
+	if err := enc.Encode(struct {
+		ID encodeID `toml:"id,omitempty"`
+	}{encodeID{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if encodeIDCalls != 1 {
+		t.Errorf("want MarshalText to be called once, got %d calls",
+			encodeIDCalls)
+	}
+
+	buf.Reset()
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "id = \"id-1\"\nalways = \"\"\ninline = { other = \"id-2\" }\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("with OmitEmptyText: want %q, got %q", expected, got)
+	}
+}
+
+// encodeVersion is written as "major.minor" by its MarshalText method.
+type encodeVersion struct{ Major, Minor int }
+
+func (v encodeVersion) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d.%d", v.Major, v.Minor)), nil
+}
+
+func (v encodeVersion) String() string { return "v" }
+
+func TestEncodeIgnoreTextMarshaler(t *testing.T) {
+	type conf struct {
+		Version  encodeVersion
+		Versions []encodeVersion
+		Updated  time.Time
+	}
+	val := conf{
+		Version:  encodeVersion{1, 2},
+		Versions: []encodeVersion{{3, 4}},
+		Updated:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	encodeExpected(t, "TextMarshaler", val, `Version = "1.2"
+Versions = ["3.4"]
+Updated = 2020-01-02T03:04:05Z
+`, nil)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.IgnoreTextMarshaler = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Updated = 2020-01-02T03:04:05Z
+
+[Version]
+  Major = 1
+  Minor = 2
+
+[[Versions]]
+  Major = 3
+  Minor = 4
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	// Without MarshalText, EnumAsString applies to the String method.
+	buf.Reset()
+	enc.EnumAsString = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected = "Version = \"v\"\nVersions = [\"v\"]\n" +
+		"Updated = 2020-01-02T03:04:05Z\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+// encodeSecret is written as "***", or not at all if it's empty.
+type encodeSecret string
+
+func (s encodeSecret) TOMLValue() interface{} {
+	if s == "" {
+		return nil
+	}
+	return "***"
+}
+
+// encodeAddr is written as a table with its host and port.
+type encodeAddr string
+
+func (a encodeAddr) TOMLValue() interface{} {
+	host, port, _ := net.SplitHostPort(string(a))
+	return map[string]string{"host": host, "port": port}
+}
+
+// encodeLoop returns itself from TOMLValue.
+type encodeLoop struct{}
+
+func (l encodeLoop) TOMLValue() interface{} { return l }
+
+func TestEncodeTOMLValuer(t *testing.T) {
+	type conf struct {
+		User     string
+		Password encodeSecret
+		Token    encodeSecret
+		Keys     []encodeSecret
+		Ptr      *encodeSecret
+		Addr     encodeAddr
+	}
+	pw := encodeSecret("pw")
+	val := conf{
+		User:     "u",
+		Password: "hunter2",
+		Keys:     []encodeSecret{"a", "b"},
+		Ptr:      &pw,
+		Addr:     "localhost:80",
+	}
+	expected := `User = "u"
+Password = "***"
+Keys = ["***", "***"]
+Ptr = "***"
+
+[Addr]
+  host = "localhost"
+  port = "80"
+`
+	encodeExpected(t, "TOMLValuer", val, expected, nil)
+	encodeExpected(t, "TOMLValuer in map", map[string]interface{}{
+		"a": encodeSecret("x"), "b": encodeSecret(""),
+		"t": map[string]encodeSecret{"c": "y"},
+	}, "a = \"***\"\n\n[t]\n  c = \"***\"\n", nil)
+	encodeExpected(t, "TOMLValuer in inline table", struct {
+		T conf `toml:",inline"`
+	}{conf{Password: "x"}}, "T = { User = \"\", Password = \"***\", "+
+		"Addr = { host = \"\", port = \"\" } }\n", nil)
+	encodeExpected(t, "TOMLValuer returning a TOMLValuer",
+		map[string]interface{}{"l": encodeLoop{}}, "", errAnything)
+}
+
+// encodeCounter counts the calls to its TOMLValue method, and is written as a
+// table or a string.
+type encodeCounter struct {
+	calls *int
+	table bool
+}
+
+func (c encodeCounter) TOMLValue() interface{} {
+	*c.calls++
+	if c.table {
+		return map[string]int{"a": 1}
+	}
+	return "x"
+}
+
+func TestEncodeTOMLValuerCalls(t *testing.T) {
+	calls := make([]int, 5)
+	counter := func(i int, table bool) encodeCounter {
+		return encodeCounter{&calls[i], table}
+	}
+	val := struct {
+		S    encodeCounter
+		T    encodeCounter
+		I    encodeCounter `toml:",inline"`
+		List []encodeCounter
+		M    map[string]interface{}
+	}{
+		S:    counter(0, false),
+		T:    counter(1, true),
+		I:    counter(2, true),
+		List: []encodeCounter{counter(3, false)},
+		M:    map[string]interface{}{"c": counter(4, false)},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.AlignValues = true
+	enc.ArrayStyle = ArrayAuto
+	enc.ArrayWidth = 10
+	enc.InlineTableWidth = 10
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range calls {
+		if n != 1 {
+			t.Errorf("counter %d: want 1 call to TOMLValue, got %d", i, n)
+		}
+	}
+}
+
+// encodeLimit is a tri-state value: unlimited (-1), unset (Null) or a limit.
+type encodeLimit int
+
+func (l encodeLimit) TOMLValue() interface{} {
+	if l == 0 {
+		return Null{}
+	}
+	return int(l)
+}
+
+func TestEncodeNull(t *testing.T) {
+	type conf struct {
+		Null    interface{}
+		Ptr     *Null
+		Missing interface{}
+		Limits  []encodeLimit
+		Limit   encodeLimit
+		Values  map[string]interface{}
+	}
+	val := conf{
+		Null:   Null{},
+		Ptr:    &Null{},
+		Limits: []encodeLimit{0},
+		Values: map[string]interface{}{"a": Null{}},
+	}
+	encodeExpected(t, "null", val, `Null = ""
+Ptr = ""
+Limits = [""]
+Limit = ""
+
+[Values]
+  a = ""
+`, nil)
+
+	// Null values are strings, which can be mixed with other values in
+	// TOML 1.0.
+	val.Limits = []encodeLimit{-1, 0, 5}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.NullRepresentation = "null"
+	enc.Spec = TOML10
+	enc.AllowMixedArrays = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Null = "null"
+Ptr = "null"
+Limits = [-1, "null", 5]
+Limit = "null"
+
+[Values]
+  a = "null"
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+func TestEncodeStringOption(t *testing.T) {
+	port := 8080
+	type inner struct{ N int }
+	type conf struct {
+		Port    int            `toml:"port,string"`
+		Ratio   float64        `toml:"ratio,string"`
+		Enabled bool           `toml:"enabled,string"`
+		Count   uint8          `toml:",string"`
+		Ptr     *int           `toml:"ptr,string"`
+		Name    string         `toml:"name,string"`
+		Ports   []int          `toml:"ports,string"`
+		Plain   int            `toml:"plain"`
+		Table   inner          `toml:"table,string"`
+		Map     map[string]int `toml:"map,string"`
+	}
+	val := conf{
+		Port: 8080, Ratio: 0.5, Enabled: true, Count: 3, Ptr: &port,
+		Name: "n", Ports: []int{1, 2}, Plain: 1,
+		Table: inner{2}, Map: map[string]int{"a": 3},
+	}
+	expected := `port = "8080"
+ratio = "0.5"
+enabled = "true"
+Count = "3"
+ptr = "8080"
+name = "n"
+ports = [1, 2]
+plain = 1
+
+[table]
+  N = 2
+
+[map]
+  a = 3
+`
+	encodeExpected(t, "string option", val, expected, nil)
+}
+
+func TestEncodeJSONTagFallback(t *testing.T) {
+	type conf struct {
+		JSONOnly  int    `json:"json_only"`
+		JSONOmit  int    `json:"json_omit,omitempty"`
+		JSONSkip  int    `json:"-"`
+		JSONDash  int    `json:"-,"`
+		JSONOpts  string `json:",string"`
+		TOMLOnly  int    `toml:"toml_only"`
+		Both      int    `toml:"toml_name" json:"json_name,omitempty"`
+		Untagged  int
+		TOMLEmpty int `toml:"" json:"ignored"`
+	}
+	val := conf{JSONSkip: 1, JSONDash: 2, JSONOpts: "s", TOMLOnly: 3}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.UseJSONTagFallback = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "json_only = 0\n- = 2\nJSONOpts = \"s\"\ntoml_only = 3\n" +
+		"toml_name = 0\nUntagged = 0\nignored = 0\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("with fallback: want\n%s\nbut got\n%s", expected, got)
+	}
+
+	expected = "JSONOnly = 0\nJSONOmit = 0\nJSONSkip = 1\nJSONDash = 2\n" +
+		"JSONOpts = \"s\"\ntoml_only = 3\ntoml_name = 0\nUntagged = 0\n" +
+		"TOMLEmpty = 0\n"
+	encodeExpected(t, "without fallback", val, expected, nil)
+}
+
+func TestEncodeSQLNull(t *testing.T) {
+	type conf struct {
+		Name    sql.NullString
+		Unset   sql.NullString `comment:"not written"`
+		Count   sql.NullInt64
+		Ratio   sql.NullFloat64
+		Enabled sql.NullBool
+		Names   []sql.NullString
+		Table   map[string]sql.NullInt64
+	}
+	val := conf{
+		Name:    sql.NullString{String: "x", Valid: true},
+		Unset:   sql.NullString{String: "ignored"},
+		Count:   sql.NullInt64{Int64: 3, Valid: true},
+		Ratio:   sql.NullFloat64{Float64: 1.5},
+		Enabled: sql.NullBool{Bool: true, Valid: true},
+		Names:   []sql.NullString{{String: "a", Valid: true}},
+		Table: map[string]sql.NullInt64{
+			"set":   {Int64: 1, Valid: true},
+			"unset": {Int64: 2},
+		},
+	}
+	expected := "Name = \"x\"\nCount = 3\nEnabled = true\nNames = [\"a\"]\n" +
+		"\n[Table]\n  set = 1\n"
+	encodeExpected(t, "sql null types", val, expected, nil)
+
+	encodeExpected(t, "invalid array element", map[string]interface{}{
+		"a": []sql.NullString{{}},
+	}, "", arrayNilElementError{0})
+}
+
+func TestEncodeComplex(t *testing.T) {
+	val := struct {
+		C64  complex64
+		C128 complex128
+		List []complex128
+	}{3 + 4i, -1.5 + 0i, []complex128{1i}}
+
+	tests := map[string]interface{}{
+		"C64":  struct{ C64 complex64 }{val.C64},
+		"List": struct{ List []complex128 }{val.List},
+		"m.c":  map[string]interface{}{"m": map[string]interface{}{"c": 1i}},
+	}
+	for key, v := range tests {
+		var buf bytes.Buffer
+		err := NewEncoder(&buf).Encode(v)
+		if err == nil {
+			t.Errorf("%s: expected error", key)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), errUnsupportedType.Error()) ||
+			!strings.Contains(err.Error(), "'"+key+"'") {
+			t.Errorf("%s: unexpected error: %s", key, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.ComplexAsString = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "C64 = \"(3+4i)\"\nC128 = \"(-1.5+0i)\"\nList = [\"(0+1i)\"]\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, got)
+	}
+}
+
+func TestEncodeUnsupportedKinds(t *testing.T) {
+	tests := map[string]interface{}{
+		"P":   struct{ P uintptr }{1},
+		"C":   struct{ C chan int }{make(chan int)},
+		"F":   struct{ F func() }{func() {}},
+		"T.F": struct{ T struct{ F func() } }{},
+		"L":   struct{ L []uintptr }{[]uintptr{1}},
+		"m.c": map[string]interface{}{"m": map[string]interface{}{
+			"c": make(chan int),
+		}},
+		"m.p": map[string]map[string]uintptr{"m": {"p": 1}},
+	}
+	for key, v := range tests {
+		var buf bytes.Buffer
+		err := NewEncoder(&buf).Encode(v)
+		if err == nil {
+			t.Errorf("%s: expected error", key)
+			continue
+		}
+		if _, ok := err.(*EncodeError); !ok {
+			t.Errorf("%s: want *EncodeError, got %T", key, err)
+		}
+		if !strings.HasPrefix(err.Error(), errUnsupportedType.Error()) ||
+			!strings.Contains(err.Error(), "'"+key+"'") {
+			t.Errorf("%s: unexpected error: %s", key, err)
+		}
+	}
+}
+
+func TestEncodeSkipUnsupported(t *testing.T) {
+	type state struct {
+		Lock sync.Mutex
+		Done chan struct{}
+	}
+	type config struct {
+		Name     string
+		Mu       sync.Mutex
+		OnChange func()
+		Ptr      uintptr
+		Empty    struct{}
+		State    state
+		Values   map[string]interface{}
+		Inline   state `toml:",inline"`
+	}
+	val := &config{
+		Name:     "x",
+		OnChange: func() {},
+		State:    state{Done: make(chan struct{})},
+		Values: map[string]interface{}{
+			"a": 1, "f": func() {}, "c": 1i, "m": &sync.Mutex{},
+		},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SkipUnsupported = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Name = "x"
+Inline = {}
+
+[Empty]
+
+[State]
+
+[Values]
+  a = 1
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	// Without SkipUnsupported, the func is an error.
+	if err := NewEncoder(&buf).Encode(val); err == nil {
+		t.Error("expected error without SkipUnsupported")
+	}
+}
+
+func TestEncodeCollectErrors(t *testing.T) {
+	type point struct{ X, Y int }
+	type conf struct {
+		Name  string
+		Mixed []interface{}
+		Ch    chan int
+		Port  int
+		Keys  map[point]int
+		Table struct {
+			C complex64
+			N int
+		}
+	}
+	val := conf{
+		Name:  "a",
+		Mixed: []interface{}{1, "b"},
+		Ch:    make(chan int),
+		Port:  80,
+		Keys:  map[point]int{{1, 2}: 3},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(val); underlying(err) != errArrayMixedElementTypes {
+		t.Errorf("by default: want error %v, got %v",
+			errArrayMixedElementTypes, err)
+	}
+
+	enc.CollectErrors = true
+	err := enc.Encode(val)
+	errs, ok := err.(EncodeErrors)
+	if !ok {
+		t.Fatalf("want EncodeErrors, got %T: %v", err, err)
+	}
+	want := []string{"Mixed", "Ch", "Keys", "Table.C"}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Key.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want errors for keys %q, got %q:\n%s", want, got, err)
+	}
+	if errs[0].Err != errArrayMixedElementTypes || errs[2].Err != errNonString {
+		t.Errorf("unexpected errors:\n%s", err)
+	}
+	if n := strings.Count(err.Error(), "\n"); n != len(want)-1 {
+		t.Errorf("want one line per error, got:\n%s", err)
+	}
+	if unwrapped := errs.Unwrap(); len(unwrapped) != len(errs) ||
+		unwrapped[2] != error(errs[2]) {
+		t.Errorf("Unwrap: want the errors, got %v", unwrapped)
+	}
+
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	enc.CollectErrors = true
+	if err := enc.Encode(map[string]int{"a": 1}); err != nil {
+		t.Errorf("valid value: Encode failed: %s", err)
+	}
+	if got := buf.String(); got != "a = 1\n" {
+		t.Errorf("valid value: want %q, got %q", "a = 1\n", got)
+	}
+
+	// Values inside inline tables are reported once, with their own key,
+	// even though the table is measured before it's written.
+	type inner struct {
+		M []interface{} `toml:"m"`
+	}
+	inline := struct {
+		A int
+		T inner `toml:"t,inline"`
+	}{1, inner{[]interface{}{1, "x"}}}
+	enc = NewEncoder(ioutil.Discard)
+	enc.CollectErrors = true
+	err = enc.Encode(inline)
+	if errs, ok := err.(EncodeErrors); !ok || len(errs) != 1 ||
+		errs[0].Key.String() != "t.m" ||
+		errs[0].Err != errArrayMixedElementTypes {
+		t.Errorf("inline: want one error for key 't.m', got %v", err)
+	}
+
+	enc.MaxDepth = 1
+	err = enc.Encode(val)
+	if underlying(err) != ErrMaxDepth {
+		t.Errorf("MaxDepth: want error %v, got %v", ErrMaxDepth, err)
+	}
+}
+
+func TestEncodeSyncMap(t *testing.T) {
+	type conf struct {
+		Name  string
+		Cache sync.Map
+		Ptr   *sync.Map
+		Small sync.Map `toml:",inline"`
+	}
+	val := &conf{Name: "x", Ptr: &sync.Map{}}
+	for _, k := range []string{"c", "a", "b"} {
+		val.Cache.Store(k, len(k))
+	}
+	val.Cache.Store("t", map[string]int{"z": 1})
+	val.Cache.Store("nil", nil)
+	val.Ptr.Store("p", "q")
+	val.Small.Store("s", true)
+
+	expected := `Name = "x"
+Small = { s = true }
+
+[Cache]
+  a = 1
+  b = 1
+  c = 1
+  [Cache.t]
+    z = 1
+
+[Ptr]
+  p = "q"
+`
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SkipUnsupported = true
+		if err := enc.Encode(val); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != expected {
+			t.Fatalf("want\n%s\nbut got\n%s", expected, got)
+		}
+	}
+
+	var m sync.Map
+	m.Store("a", 1)
+	encodeExpected(t, "top-level sync.Map", &m, "a = 1\n", nil)
+	m.Store(1, 2)
+	encodeExpected(t, "non-string key", &m, "", errNonString)
+
+	// The map is read once, when its field is classified, so a key stored
+	// after that (while S is classified) doesn't show up.
+	changing := &sync.Map{}
+	changing.Store("a", 1)
+	encodeExpected(t, "changing sync.Map", struct {
+		M *sync.Map
+		S encodeStorer
+	}{changing, encodeStorer{changing}}, "S = 1\n\n[M]\n  a = 1\n", nil)
+}
+
+// encodeStorer stores the key "z" in a sync.Map when it's encoded.
+type encodeStorer struct {
+	m *sync.Map
+}
+
+func (s encodeStorer) TOMLValue() interface{} {
+	s.m.Store("z", 2)
+	return 1
+}
+
+func TestEncodeJSONRawMessage(t *testing.T) {
+	val := map[string]json.RawMessage{
+		"array":  json.RawMessage(`[1, 2, 3]`),
+		"null":   json.RawMessage(`null`),
+		"number": json.RawMessage(`1.5`),
+		"object": json.RawMessage(`{"name": "a", "n": 1, "t": {"b": true}}`),
+		"string": json.RawMessage(`"a\u00e9"`),
+		"tables": json.RawMessage(`[{"a": 1}, {"a": 2}]`),
+	}
+	encodeExpected(t, "map", val, `array = [1, 2, 3]
+number = 1.5
+string = "aé"
+
+[object]
+  n = 1
+  name = "a"
+  [object.t]
+    b = true
+
+[[tables]]
+  a = 1
+
+[[tables]]
+  a = 2
+`, nil)
+
+	type conf struct {
+		Name  string
+		Extra json.RawMessage
+		Empty json.RawMessage
+	}
+	encodeExpected(t, "struct field",
+		conf{Name: "a", Extra: json.RawMessage(`{"x": [true]}`)},
+		"Name = \"a\"\n\n[Extra]\n  x = [true]\n", nil)
+
+	for _, raw := range []string{`{"x": }`, `[1] [2]`, `"a`} {
+		var buf bytes.Buffer
+		err := NewEncoder(&buf).Encode(conf{Extra: json.RawMessage(raw)})
+		if err == nil || !strings.Contains(err.Error(), "key 'Extra'") {
+			t.Errorf("%s: want error for key 'Extra', got %v", raw, err)
+		}
+	}
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(map[string][]json.RawMessage{
+		"list": {json.RawMessage(`"a"`), json.RawMessage(`"b`)},
+	})
+	if err == nil || !strings.Contains(err.Error(), "key 'list'") {
+		t.Errorf("array: want error for key 'list', got %v", err)
+	}
+}
+
+func TestEncodeJSONRawMessageDecodedOnce(t *testing.T) {
+	enc := NewEncoder(ioutil.Discard)
+	rv := reflect.ValueOf(json.RawMessage(`{"a": 1}`))
+	first, err := enc.jsonRawMessageValue(rv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := enc.jsonRawMessageValue(rv)
+	if first.Pointer() != again.Pointer() {
+		t.Error("json.RawMessage was decoded again")
+	}
+}
+
+func TestEncodeComments(t *testing.T) {
+	type section struct {
+		V int `toml:"v,omitzero" comment:"the value"`
+	}
+	type conf struct {
+		Name     string            `comment:"the name\nsecond line"`
+		Empty    map[string]string `toml:"empty,omitempty" comment:"fill me in"`
+		Nil      *section          `toml:"nil" comment:"optional"`
+		Zero     section           `toml:"zero,omitzero" comment:"zero"`
+		Section  section           `toml:"section" comment:"a section"`
+		Omitted  map[string]string `toml:"omitted,omitempty"`
+		Sections []section         `toml:"sections" comment:"many"`
+	}
+	val := conf{
+		Name:     "x",
+		Empty:    map[string]string{},
+		Omitted:  map[string]string{},
+		Section:  section{1},
+		Sections: []section{{2}, {3}},
+	}
+	expected := `# the name
+# second line
+Name = "x"
+
+# fill me in
+[empty]
+
+# optional
+[nil]
+
+# zero
+[zero]
+
+# a section
+[section]
+  # the value
+  v = 1
+
+# many
+[[sections]]
+  # the value
+  v = 2
+
+[[sections]]
+  # the value
+  v = 3
+`
+	encodeExpected(t, "comments", val, expected, nil)
+
+	// The comment of a field that's left out isn't written anywhere.
+	type item struct {
+		A int
+		B int `toml:",omitempty" comment:"b comment"`
+	}
+	items := struct{ Items []item }{[]item{{A: 1}, {A: 2}}}
+	expected = `[[Items]]
+  A = 1
+
+[[Items]]
+  A = 2
+`
+	encodeExpected(t, "skipped comment", items, expected, nil)
+}
+
+func TestEncodeDuplicateKeys(t *testing.T) {
+	type A struct{ Name string }
+	type B struct{ Name string }
+	type Tagged struct {
+		Name  string
+		Other string `toml:"Name"`
+	}
+	tests := map[string]interface{}{
+		"embedded structs": struct {
+			A
+			B
+		}{A{"a"}, B{"b"}},
+		"tag":    Tagged{"a", "b"},
+		"nested": struct{ T Tagged }{Tagged{"a", "b"}},
+	}
+	for label, val := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.DetectDuplicateKeys = true
+		err := enc.Encode(val)
+		if err == nil || !strings.HasPrefix(err.Error(), errDuplicateKey.Error()) {
+			t.Errorf("%s: want error %v, got %v", label, errDuplicateKey, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.DetectDuplicateKeys = true
+	val := struct {
+		A
+		Name  string `toml:"-"`
+		Other string
+	}{A: A{"a"}, Name: "x", Other: "b"}
+	if err := enc.Encode(val); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestEncodeDuplicateTables(t *testing.T) {
+	type server struct {
+		Host string `toml:"host"`
+		Sub  struct {
+			A int `toml:"a"`
+		} `toml:"sub"`
+	}
+	type Base struct {
+		Server server `toml:"server"`
+	}
+	type conf struct {
+		Base
+		Extra map[string]interface{} `toml:"server"`
+		Name  string                 `toml:"name"`
+	}
+	val := conf{
+		Base: Base{server{Host: "localhost"}},
+		Extra: map[string]interface{}{
+			"port": 8080,
+			"tls":  map[string]bool{"enabled": true},
+		},
+		Name: "n",
+	}
+	// The keys of both tables are written before their sub-tables.
+	expected := `name = "n"
+
+[server]
+  host = "localhost"
+  port = 8080
+  [server.sub]
+    a = 0
+  [server.tls]
+    enabled = true
+`
+	encodeExpected(t, "merged tables", val, expected, nil)
+
+	var decoded map[string]interface{}
+	if _, err := Decode(expected, &decoded); err != nil {
+		t.Errorf("merged tables don't decode: %s", err)
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.DetectDuplicateKeys = true
+	err := enc.Encode(val)
+	if err == nil || !strings.Contains(err.Error(), "'server'") {
+		t.Errorf("want duplicate key error for 'server', got %v", err)
+	}
+}
+
+func TestEncodeCycle(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	cyclic := &node{Name: "loop"}
+	cyclic.Next = cyclic
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(cyclic)
+	if err == nil || !strings.HasPrefix(err.Error(), errCyclicReference.Error()) {
+		t.Errorf("want error %v, got %v", errCyclicReference, err)
+	}
+
+	m := map[string]interface{}{}
+	m["self"] = m
+	err = NewEncoder(&buf).Encode(map[string]interface{}{"m": m})
+	if err == nil || !strings.HasPrefix(err.Error(), errCyclicReference.Error()) {
+		t.Errorf("want error %v, got %v", errCyclicReference, err)
+	}
+
+	// Sharing a value without a cycle is fine.
+	shared := &node{Name: "shared"}
+	val := struct{ A, B *node }{shared, shared}
+	expected := "[A]\n  Name = \"shared\"\n\n[B]\n  Name = \"shared\"\n"
+	encodeExpected(t, "shared pointer", val, expected, nil)
+}
+
+func TestEncodeLimits(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	val := &node{"a", &node{"b", &node{"c", nil}}}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.MaxDepth = 4
+	if err := enc.Encode(val); underlying(err) != ErrMaxDepth {
+		t.Errorf("MaxDepth: want error %v, got %v", ErrMaxDepth, err)
+	}
+	enc.MaxDepth = 10
+	if err := enc.Encode(val); err != nil {
+		t.Errorf("MaxDepth: Encode failed: %s", err)
+	}
+
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	enc.MaxBytes = 12
+	if err := enc.Encode(map[string]int{"a": 1, "b": 2}); err != nil {
+		t.Errorf("MaxBytes: Encode failed: %s", err)
+	}
+	buf.Reset()
+	err := enc.Encode(map[string]int{"a": 1, "b": 2, "c": 3})
+	if underlying(err) != ErrMaxBytes {
+		t.Errorf("MaxBytes: want error %v, got %v", ErrMaxBytes, err)
+	}
+
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	enc.MaxArrayTableElements = 2
+	type row struct{ N int }
+	rows := map[string][]row{"rows": {{1}, {2}}}
+	if err := enc.Encode(rows); err != nil {
+		t.Errorf("MaxArrayTableElements: Encode failed: %s", err)
+	}
+	buf.Reset()
+	rows["rows"] = append(rows["rows"], row{3})
+	err = enc.Encode(rows)
+	if err == nil || !strings.Contains(err.Error(), "has 3 elements") ||
+		!strings.Contains(err.Error(), "key 'rows'") {
+		t.Errorf("MaxArrayTableElements: want error, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("MaxArrayTableElements: wrote %q", buf.String())
+	}
+}
+
+// encodeChunkWriter records every Write call, and fails once it has been
+// called failAfter times if failAfter is positive.
+type encodeChunkWriter struct {
+	chunks    []string
+	failAfter int
+}
+
+func (w *encodeChunkWriter) Write(p []byte) (int, error) {
+	if w.failAfter > 0 && len(w.chunks) == w.failAfter {
+		return 0, errors.New("connection reset")
+	}
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+func TestEncodeFlushInterval(t *testing.T) {
+	type row struct{ N int }
+	val := struct {
+		Title string
+		A, B  map[string]int
+		Rows  []row
+	}{"t", map[string]int{"a": 1}, map[string]int{"b": 2}, []row{{1}, {2}}}
+
+	tests := []struct {
+		interval int
+		chunks   []string
+	}{
+		{0, []string{
+			"Title = \"t\"\n\n[A]\n  a = 1\n\n[B]\n  b = 2\n\n" +
+				"[[Rows]]\n  N = 1\n\n[[Rows]]\n  N = 2\n",
+		}},
+		{1, []string{
+			"Title = \"t\"\n\n[A]\n  a = 1",
+			"\n\n[B]\n  b = 2",
+			"\n\n[[Rows]]\n  N = 1",
+			"\n\n[[Rows]]\n  N = 2\n",
+		}},
+		{2, []string{
+			"Title = \"t\"\n\n[A]\n  a = 1\n\n[B]\n  b = 2",
+			"\n\n[[Rows]]\n  N = 1\n\n[[Rows]]\n  N = 2\n",
+		}},
+	}
+	for _, test := range tests {
+		w := &encodeChunkWriter{}
+		enc := NewEncoder(w)
+		enc.FlushInterval = test.interval
+		if err := enc.Encode(val); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(w.chunks, test.chunks) {
+			t.Errorf("FlushInterval %d: want chunks %q, got %q",
+				test.interval, test.chunks, w.chunks)
+		}
+	}
+
+	w := &encodeChunkWriter{failAfter: 1}
+	enc := NewEncoder(w)
+	enc.FlushInterval = 1
+	enc.CollectErrors = true
+	err := enc.Encode(val)
+	if err == nil || underlying(err).Error() != "connection reset" {
+		t.Errorf("want error %q, got %v", "connection reset", err)
+	}
+	if len(w.chunks) != 1 {
+		t.Errorf("want encoding to stop after the error, got %q", w.chunks)
+	}
+}
+
+func TestEncodeErrorPosition(t *testing.T) {
+	val := struct {
+		Name  string
+		Table struct {
+			A int
+			C complex128
+		}
+	}{Name: "x"}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	err := enc.Encode(val)
+	encErr, ok := err.(*EncodeError)
+	if !ok {
+		t.Fatalf("want *EncodeError, got %T (%v)", err, err)
+	}
+	// Name = "x"\n\n[Table]\n  A = 0\n
+	const offset = 11 + 9 + 8
+	if !strings.HasPrefix(encErr.Err.Error(), errUnsupportedType.Error()) ||
+		encErr.Key.String() != "Table.C" || encErr.Offset != offset {
+		t.Errorf("want unsupported type error for key Table.C at byte %d, "+
+			"got %#v", offset, encErr)
+	}
+	if enc.BytesWritten() != offset {
+		t.Errorf("want %d bytes written, got %d", offset, enc.BytesWritten())
+	}
+	if want := " (key 'Table.C', at byte 28)"; !strings.HasSuffix(err.Error(),
+		want) {
+		t.Errorf("want message ending in %q, got %q", want, err.Error())
+	}
+
+	if err := enc.Encode(map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if enc.BytesWritten() != 6 {
+		t.Errorf("want 6 bytes written, got %d", enc.BytesWritten())
+	}
+}
+
+func TestEncodeReset(t *testing.T) {
+	var buf1, buf2 bytes.Buffer
+	enc := NewEncoder(&buf1)
+	enc.Indent = "\t"
+	if err := enc.Encode(map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	enc.Reset(&buf2)
+	val := map[string]interface{}{"t": map[string]int{"b": 2}}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf1.String(), "a = 1\n"; got != want {
+		t.Errorf("first writer: want %q, got %q", want, got)
+	}
+	// No leading newline should be written, since nothing has been written
+	// to the new writer yet.
+	if got, want := buf2.String(), "[t]\n\tb = 2\n"; got != want {
+		t.Errorf("second writer: want %q, got %q", want, got)
+	}
+}
+
+func TestEncodeClone(t *testing.T) {
+	var buf1, buf2, buf3 bytes.Buffer
+	tmpl := NewEncoder(&buf1)
+	tmpl.Indent = "\t"
+	tmpl.RedactKeys = map[string]string{"t.secret": "***"}
+	tmpl.RegisterTypeEncoder(reflect.TypeOf(encodeDecimal{}),
+		func(v interface{}) ([]byte, error) { return []byte("decimal"), nil })
+	if err := tmpl.Encode(map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The clone doesn't write a leading newline, since nothing has been
+	// written to its writer yet.
+	enc := tmpl.Clone(&buf2)
+	val := map[string]interface{}{"t": map[string]interface{}{
+		"d": encodeDecimal{1, 0}, "secret": "hunter2",
+	}}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf1.String(), "a = 1\n"; got != want {
+		t.Errorf("template: want %q, got %q", want, got)
+	}
+	want := "[t]\n\td = \"decimal\"\n\tsecret = \"***\"\n"
+	if got := buf2.String(); got != want {
+		t.Errorf("clone: want %q, got %q", want, got)
+	}
+
+	// Changing the options or type encoders of the clone doesn't affect the
+	// template.
+	enc.Indent = "  "
+	enc.RegisterTypeEncoder(reflect.TypeOf(encodeDecimal{}), nil)
+	tmpl.Reset(&buf3)
+	if err := tmpl.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf3.String(); got != want {
+		t.Errorf("template after clone: want %q, got %q", want, got)
+	}
+}
+
+func TestEncodeFinalNewline(t *testing.T) {
+	type table struct{ B int }
+	tests := map[string]interface{}{
+		"keys":           map[string]int{"a": 1},
+		"table":          struct{ T table }{table{1}},
+		"empty table":    struct{ T struct{} }{},
+		"array of table": struct{ T []table }{[]table{{1}, {2}}},
+		"expanded array": map[string][]int{"a": {1, 2}},
+	}
+	for label, val := range tests {
+		for _, final := range []bool{true, false} {
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf)
+			enc.Header = "header"
+			enc.ArrayStyle = ArrayExpanded
+			enc.FinalNewline = final
+			if err := enc.Encode(val); err != nil {
+				t.Fatalf("%s: %s", label, err)
+			}
+			out := buf.String()
+			switch {
+			case final && (!strings.HasSuffix(out, "\n") ||
+				strings.HasSuffix(out, "\n\n")):
+				t.Errorf("%s: want exactly one final newline, got %q", label,
+					out)
+			case !final && strings.HasSuffix(out, "\n"):
+				t.Errorf("%s: want no final newline, got %q", label, out)
+			}
+			if enc.BytesWritten() != len(out) {
+				t.Errorf("%s: want %d bytes written, got %d", label, len(out),
+					enc.BytesWritten())
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.FinalNewline = false
+	for _, val := range []interface{}{
+		map[string]int{"a": 1},
+		map[string]map[string]int{"t": {"b": 2}},
+	} {
+		if err := enc.Encode(val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := "a = 1\n\n[t]\n  b = 2"; buf.String() != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := NewEncoder(&buf).Encode(struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("want no output for an empty document, got %q", buf.String())
+	}
+}
+
+func TestEncodeStats(t *testing.T) {
+	type server struct {
+		Name string
+		Tags []string
+	}
+	val := struct {
+		Title   string
+		Owner   struct{ Name, Email string }
+		Servers []server
+	}{Title: "t", Servers: []server{{"a", nil}, {"b", []string{"x"}}}}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := EncodeStats{Tables: 1, ArrayTables: 2, Keys: 6,
+		Bytes: buf.Len()}
+	if stats := enc.Stats(); stats != expected {
+		t.Errorf("want %+v, got %+v", expected, stats)
+	}
+
+	enc.Reset(&buf)
+	if stats := enc.Stats(); stats != (EncodeStats{}) {
+		t.Errorf("want no stats after Reset, got %+v", stats)
+	}
+}
+
+func TestEncodeSliceOfPointers(t *testing.T) {
+	one, two := 1, 2
+	type table struct{ V int }
+	val := struct {
+		Ints   []*int
+		Nested [][]*int
+		Tables []*table
+	}{
+		Ints:   []*int{&one, nil, &two},
+		Nested: [][]*int{{nil}, {&one}},
+		Tables: []*table{nil, {1}},
+	}
+
+	encodeExpected(t, "no nils", struct{ Ints []*int }{[]*int{&one, &two}},
+		"Ints = [1, 2]\n", nil)
+
+	half, str := 0.5, "s"
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	encodeExpected(t, "other primitives", struct {
+		Floats  []*float64
+		Strings []*string
+		Times   []*time.Time
+	}{[]*float64{&half}, []*string{&str}, []*time.Time{&date, &date}},
+		"Floats = [0.5]\nStrings = [\"s\"]\n"+
+			"Times = [2020-01-02T03:04:05Z, 2020-01-02T03:04:05Z]\n", nil)
+	encodeExpected(t, "nil float", struct{ Floats []*float64 }{
+		[]*float64{&half, nil},
+	}, "", arrayNilElementError{1})
+	encodeExpected(t, "nil element", val, "", arrayNilElementError{1})
+	encodeExpected(t, "nil table", struct{ Tables []*table }{val.Tables},
+		"", arrayNilElementError{0})
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SkipNilArrayElements = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Ints = [1, 2]\nNested = [[], [1]]\n\n[[Tables]]\n  V = 1\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("SkipNilArrayElements: want %q, got %q", expected, got)
+	}
+
+	// Arrays of tables in inline tables.
+	inline := struct {
+		T struct{ Tables []*table } `toml:",inline"`
+	}{}
+	inline.T.Tables = []*table{{1}, nil}
+	encodeExpected(t, "nil inline table", inline, "", arrayNilElementError{1})
+	buf.Reset()
+	if err := enc.Encode(inline); err != nil {
+		t.Fatal(err)
+	}
+	expected = "T = { Tables = [{ V = 1 }] }\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("SkipNilArrayElements inline: want %q, got %q", expected,
+			got)
+	}
+}
+
+func TestEncodeTypedNilInterface(t *testing.T) {
+	type table struct{ V int }
+	var buf *bytes.Buffer
+	val := struct {
+		Table    interface{}
+		Writer   io.Writer
+		Embedded interface{} `modifier:"embedded_toml"`
+		Inline   interface{} `toml:",inline"`
+		Map      interface{}
+		List     []interface{}
+		After    int
+	}{
+		Table:    (*table)(nil),
+		Writer:   buf,
+		Embedded: (*table)(nil),
+		Inline:   (*table)(nil),
+		Map:      map[string]int(nil),
+		List:     []interface{}{1, (*int)(nil), 2},
+		After:    1,
+	}
+
+	encodeExpected(t, "typed nil array element", val, "",
+		arrayNilElementError{1})
+
+	var out bytes.Buffer
+	enc := NewEncoder(&out)
+	enc.SkipNilArrayElements = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "List = [1, 2]\nAfter = 1\n"; out.String() != expected {
+		t.Errorf("want %q, got %q", expected, out.String())
+	}
+}
+
+func TestEncodeMapOfNilInterfaceValues(t *testing.T) {
+	val := map[string]interface{}{
+		"a": map[string]int(nil),
+		"b": []int(nil),
+		"c": (*int)(nil),
+		"d": 1,
+		"t": map[string]interface{}{
+			"a": map[string]int(nil),
+			"e": map[string]int{},
+		},
+	}
+	encodeExpected(t, "nil values in a map", val,
+		"d = 1\n\n[t]\n  [t.e]\n", nil)
+
+	inline := struct {
+		M map[string]interface{} `toml:",inline"`
+	}{map[string]interface{}{"a": map[string]int(nil), "b": 2}}
+	encodeExpected(t, "nil values in an inline table", inline,
+		"M = { b = 2 }\n", nil)
+}
+
+func TestEncodeNilAndEmptyContainers(t *testing.T) {
+	type conf struct {
+		NilSlice   []int
+		EmptySlice []int
+		Omitted    []int `toml:",omitempty"`
+		Zero       []int `toml:",omitzero"`
+		Values     map[string]interface{}
+		Inline     struct {
+			L []string
+			Z []string `toml:",omitzero"`
+		} `toml:",inline"`
+		NilMap   map[string]int
+		EmptyMap map[string]int
+		ZeroMap  map[string]int `toml:",omitzero"`
+	}
+	val := conf{
+		EmptySlice: []int{},
+		Values: map[string]interface{}{
+			"nil": []string(nil), "empty": []string{}, "m": map[string]int(nil),
+		},
+		EmptyMap: map[string]int{},
+	}
+	encodeExpected(t, "by default", val, `EmptySlice = []
+Inline = {}
+
+[Values]
+  empty = []
+
+[EmptyMap]
+`, nil)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EmitEmptyContainers = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `NilSlice = []
+EmptySlice = []
+Inline = { L = [] }
+
+[Values]
+  empty = []
+  nil = []
+  [Values.m]
+
+[NilMap]
+
+[EmptyMap]
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+func TestEncodeNilPointers(t *testing.T) {
+	type conf struct {
+		Int     *int
+		Str     *string
+		Bool    *bool
+		When    *time.Time
+		Omitted *int `toml:",omitempty"`
+		Ints    *[]int
+		Values  map[string]*int
+		Table   *struct{ A int }
+	}
+	n, s, b := 0, "", false
+	encodeExpected(t, "non-nil", conf{Int: &n, Str: &s, Bool: &b},
+		"Int = 0\nStr = \"\"\nBool = false\n", nil)
+
+	val := conf{Values: map[string]*int{"a": nil, "b": &n}}
+	encodeExpected(t, "nil by default", val, "[Values]\n  b = 0\n", nil)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EmitNilPointersAsZero = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Int = 0
+Str = ""
+Bool = false
+When = 0001-01-01T00:00:00Z
+
+[Values]
+  a = 0
+  b = 0
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("EmitNilPointersAsZero: want\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestEncodeMapOfPointers(t *testing.T) {
+	type table struct{ V int }
+	val := map[string]interface{}{
+		"tables": map[string]*table{
+			"a": nil,
+			"b": {1},
+			"c": nil,
+			"d": {2},
+		},
+		"mixed": map[string]interface{}{
+			"nil":    (*table)(nil),
+			"table":  &table{3},
+			"scalar": 4,
+		},
+	}
+	expected := `[mixed]
+  scalar = 4
+  [mixed.table]
+    V = 3
+
+[tables]
+  [tables.b]
+    V = 1
+  [tables.d]
+    V = 2
+`
+	encodeExpected(t, "map of pointers with nil values", val, expected, nil)
+}
+
+func TestEncodeDynamicTree(t *testing.T) {
+	type disk struct {
+		Size int `toml:"size"`
+	}
+	type server struct {
+		Disks []disk   `toml:"disks"`
+		IP    string   `toml:"ip"`
+		Tags  []string `toml:"tags"`
+	}
+	type owner struct {
+		Name string `toml:"name"`
+	}
+	type config struct {
+		Ports   []int    `toml:"ports"`
+		Title   string   `toml:"title"`
+		Owner   owner    `toml:"owner"`
+		Servers []server `toml:"servers"`
+	}
+	concrete := config{
+		Ports: []int{80, 443},
+		Title: "example",
+		Owner: owner{"tom"},
+		Servers: []server{
+			{[]disk{{1}, {2}}, "10.0.0.1", []string{"a"}},
+			{[]disk{{3}}, "10.0.0.2", []string{}},
+		},
+	}
+
+	// The same document built only from map[string]interface{} and
+	// []interface{}, with every value behind an extra interface{}.
+	var dynamic interface{} = map[string]interface{}{
+		"ports": interface{}([]interface{}{80, 443}),
+		"title": interface{}("example"),
+		"owner": interface{}(map[string]interface{}{"name": "tom"}),
+		"servers": interface{}([]interface{}{
+			interface{}(map[string]interface{}{
+				"disks": []interface{}{
+					map[string]interface{}{"size": 1},
+					interface{}(map[string]interface{}{"size": 2}),
+				},
+				"ip":   "10.0.0.1",
+				"tags": []interface{}{"a"},
+			}),
+			map[string]interface{}{
+				"disks": []interface{}{
+					map[string]interface{}{"size": 3},
+				},
+				"ip":   "10.0.0.2",
+				"tags": []interface{}{},
+			},
+		}),
+	}
+
+	var want, got bytes.Buffer
+	if err := NewEncoder(&want).Encode(concrete); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewEncoder(&got).Encode(&dynamic); err != nil {
+		t.Fatal(err)
+	}
+	if want.String() != got.String() {
+		t.Errorf("dynamic tree: want\n%s\nbut got\n%s", want.String(),
+			got.String())
+	}
+
+	deep := map[string]interface{}{
+		"a": []interface{}{
+			[]interface{}{[]interface{}{1}},
+			[]interface{}{[]interface{}{map[string]interface{}{"b": 1}}},
+		},
+	}
+	encodeExpected(t, "table nested in a later array element", deep, "",
+		errArrayNoTable)
+}
+
+func TestEncodeIndent(t *testing.T) {
+	val := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": map[string]int{"c": 1},
+		},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.SetIndent("\t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[a]\n\t[a.b]\n\t\tc = 1\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, got)
+	}
+
+	if err := enc.SetIndent("x"); err != errInvalidIndent {
+		t.Errorf("SetIndent: want error %v, got %v", errInvalidIndent, err)
+	}
+	if enc.Indent != "\t" {
+		t.Errorf("SetIndent changed indentation to %q on error", enc.Indent)
+	}
+
+	enc.Indent = " x "
+	if err := enc.Encode(val); err != errInvalidIndent {
+		t.Errorf("Encode: want error %v, got %v", errInvalidIndent, err)
+	}
+}
+
+func TestEncodeBaseIndent(t *testing.T) {
+	type server struct {
+		Name  string `toml:"name"`
+		Ports []int  `toml:"ports"`
+	}
+	val := struct {
+		Title   string   `toml:"title"`
+		Owner   server   `toml:"owner"`
+		Servers []server `toml:"servers"`
+	}{"t", server{"o", nil}, []server{{"a", []int{1, 2}}}}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.BaseIndent = 2
+	enc.Header = "fragment"
+	enc.ArrayStyle = ArrayExpanded
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+    # fragment
+
+    title = "t"
+
+    [owner]
+      name = "o"
+
+    [[servers]]
+      name = "a"
+      ports = [
+        1,
+        2
+      ]
+`[1:]
+	got := buf.String()
+	if got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+	for _, line := range strings.Split(strings.TrimRight(got, "\n"), "\n") {
+		if line != "" && !strings.HasPrefix(line, "    ") {
+			t.Errorf("line %q isn't indented by BaseIndent", line)
+		}
+	}
+
+	// The contents of embedded documents aren't indented.
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	enc.BaseIndent = 1
+	err := enc.Encode(struct {
+		Doc struct{ A int } `modifier:"embedded_toml"`
+	}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "  Doc = \"A = 0\\n\"\n"; buf.String() != want {
+		t.Errorf("embedded_toml: want %q, got %q", want, buf.String())
+	}
+}
+
+func TestEncodeKeyValueSeparator(t *testing.T) {
+	val := struct {
+		Name   string
+		Point  map[string]int `toml:",inline"`
+		Server struct{ Port int }
+	}{Name: "x", Point: map[string]int{"x": 1}}
+	val.Server.Port = 80
+
+	tests := []struct {
+		sep, expected string
+	}{
+		{"", "Name = \"x\"\nPoint = { x = 1 }\n\n[Server]\n  Port = 80\n"},
+		{" = ", "Name = \"x\"\nPoint = { x = 1 }\n\n[Server]\n  Port = 80\n"},
+		{"=", "Name=\"x\"\nPoint={ x=1 }\n\n[Server]\n  Port=80\n"},
+		{"\t= ", "Name\t= \"x\"\nPoint\t= { x\t= 1 }\n\n[Server]\n" +
+			"  Port\t= 80\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.KeyValueSeparator = test.sep
+		if err := enc.Encode(val); err != nil {
+			t.Fatalf("%q: %s", test.sep, err)
+		}
+		if got := buf.String(); got != test.expected {
+			t.Errorf("%q: want %q, got %q", test.sep, test.expected, got)
+		}
+	}
+
+	for _, sep := range []string{":", " ", "==", "= x", "\n="} {
+		enc := NewEncoder(ioutil.Discard)
+		enc.KeyValueSeparator = sep
+		if err := enc.Encode(val); err != errInvalidSeparator {
+			t.Errorf("%q: want error %v, got %v", sep, errInvalidSeparator,
+				err)
+		}
+	}
+}
+
+func TestEncodeAlignValues(t *testing.T) {
+	type server struct {
+		IP      string `toml:"ip"`
+		Enabled bool   `toml:"enabled"`
+	}
+	val := struct {
+		Title   string            `toml:"title"`
+		Version int               `toml:"version"`
+		Owner   map[string]string `toml:"owner"`
+		Servers []server          `toml:"servers"`
+	}{
+		Title:   "t",
+		Version: 1,
+		Owner:   map[string]string{"name": "o", "organization": "x", "é": "y"},
+		Servers: []server{{"10.0.0.1", true}},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.AlignValues = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+title   = "t"
+version = 1
+
+[owner]
+  name         = "o"
+  organization = "x"
+  "é"          = "y"
+
+[[servers]]
+  ip      = "10.0.0.1"
+  enabled = true
+`[1:]
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+	if n := enc.Stats().Bytes; n != len(expected) {
+		t.Errorf("Stats().Bytes: want %d but got %d", len(expected), n)
+	}
+}
+
+func TestEncodeDottedKeys(t *testing.T) {
+	type server struct {
+		Host string `toml:"host"`
+	}
+	type listener struct {
+		Port int `toml:"port,string"`
+	}
+	val := struct {
+		Title  string                 `toml:"title"`
+		Server server                 `toml:"server"`
+		Log    map[string]interface{} `toml:"log"`
+		Ports  map[string][]int       `toml:"ports"`
+		Owner  map[string]string      `toml:"owner"`
+		DB     map[string]interface{} `toml:"db"`
+		Listen listener               `toml:"listen"`
+	}{
+		Title:  "t",
+		Server: server{"x"},
+		Log:    map[string]interface{}{"level": "debug", "file": nil},
+		Ports:  map[string][]int{"http": {80, 8080}},
+		Owner:  map[string]string{"name": "o", "email": "e"},
+		DB:     map[string]interface{}{"pool": map[string]int{"max": 4}},
+		Listen: listener{8080},
+	}
+
+	collapsed := `title = "t"
+server.host = "x"
+log.level = "debug"
+
+[ports]
+  http = [80, 8080]
+
+[owner]
+  email = "e"
+  name = "o"
+
+[db]
+  pool.max = 4
+
+[listen]
+  port = "8080"
+`
+	expanded := `title = "t"
+
+[server]
+  host = "x"
+
+[log]
+  level = "debug"
+
+[ports]
+  http = [80, 8080]
+
+[owner]
+  email = "e"
+  name = "o"
+
+[db]
+  [db.pool]
+    max = 4
+
+[listen]
+  port = "8080"
+`
+	tests := []struct {
+		label    string
+		dotted   bool
+		spec     Spec
+		expected string
+	}{
+		{"collapsed", true, TOML05, collapsed},
+		{"expanded", false, TOML05, expanded},
+		{"TOML 0.4", true, TOML04, expanded},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.DottedKeys = test.dotted
+		enc.Spec = test.spec
+		if err := enc.Encode(val); err != nil {
+			t.Fatalf("%s: %s", test.label, err)
+		}
+		if got := buf.String(); got != test.expected {
+			t.Errorf("%s: want\n%s\nbut got\n%s", test.label,
+				test.expected, got)
+		}
+	}
+}
+
+type encodeStatus int
+
+func (s encodeStatus) String() string {
+	switch s {
+	case 0:
+		return "inactive"
+	case 1:
+		return "active"
+	}
+	return "unknown"
+}
+
+func TestEncodeEnumAsString(t *testing.T) {
+	val := struct {
+		Status   encodeStatus
+		Statuses []encodeStatus
+		Count    int
+		IP       net.IP
+	}{1, []encodeStatus{0, 1}, 2, net.ParseIP("127.0.0.1")}
+
+	encodeExpected(t, "enum as integer", val,
+		"Status = 1\nStatuses = [0, 1]\nCount = 2\nIP = \"127.0.0.1\"\n", nil)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EnumAsString = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Status = \"active\"\nStatuses = [\"inactive\", \"active\"]\n" +
+		"Count = 2\nIP = \"127.0.0.1\"\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, got)
+	}
+}
+
+func TestEncodeBoolAsString(t *testing.T) {
+	val := struct {
+		On    bool
+		Off   bool
+		Flags []bool
+	}{true, false, []bool{false, true}}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.BoolAsString = &[2]string{"on", "off"}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "On = \"on\"\nOff = \"off\"\nFlags = [\"off\", \"on\"]\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, got)
+	}
+
+	encodeExpected(t, "bools by default", val,
+		"On = true\nOff = false\nFlags = [false, true]\n", nil)
+
+	// Booleans spelled as literals are still written as strings.
+	buf.Reset()
+	enc.BoolAsString = &[2]string{"true", "false"}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected = "On = \"true\"\nOff = \"false\"\n" +
+		"Flags = [\"false\", \"true\"]\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, got)
+	}
+}
+
+func TestEncodeBoolLiterals(t *testing.T) {
+	type named bool
+	val := map[string]interface{}{
+		"a": true,
+		"b": named(false),
+		"c": &[]bool{true}[0],
+		"d": []interface{}{false, []bool{true}},
+		"e": map[string]bool{"f": false},
+	}
+	expected := `a = true
+b = false
+c = true
+d = [false, [true]]
+
+[e]
+  f = false
+`
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Spec = TOML10
+	enc.AllowMixedArrays = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+type encodeCelsius struct{ Degrees float64 }
+
+func TestEncodeURL(t *testing.T) {
+	u, err := url.Parse("https://example.com/path?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val := struct {
+		URL     url.URL
+		Pointer *url.URL
+		List    []*url.URL
+	}{*u, u, []*url.URL{u}}
+	expected := "URL = \"https://example.com/path?q=1\"\n" +
+		"Pointer = \"https://example.com/path?q=1\"\n" +
+		"List = [\"https://example.com/path?q=1\"]\n"
+	encodeExpected(t, "url.URL", val, expected, nil)
+}
+
+func TestEncodeRegisterEncoder(t *testing.T) {
+	typ := reflect.TypeOf(encodeCelsius{})
+	RegisterEncoder(typ, func(v interface{}) (string, error) {
+		return fmt.Sprintf("%gC", v.(encodeCelsius).Degrees), nil
+	})
+	defer RegisterEncoder(typ, nil)
+
+	val := struct {
+		Temp  encodeCelsius
+		Temps []encodeCelsius
+		Name  string
+	}{encodeCelsius{21.5}, []encodeCelsius{{1}, {2}}, "x"}
+	expected := "Temp = \"21.5C\"\nTemps = [\"1C\", \"2C\"]\nName = \"x\"\n"
+	encodeExpected(t, "registered encoder", val, expected, nil)
+
+	RegisterEncoder(typ, func(v interface{}) (string, error) {
+		return "", errors.New("bad temperature")
+	})
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(val); err == nil {
+		t.Error("expected error from registered encoder")
+	}
+}
+
+type encodeDecimal struct{ units, cents int }
+
+func TestEncodeRegisterTypeEncoder(t *testing.T) {
+	type conf struct {
+		Price  encodeDecimal
+		Prices []encodeDecimal
+		IP     net.IP
+		Ptr    *encodeDecimal
+	}
+	val := &conf{
+		Price:  encodeDecimal{1, 50},
+		Prices: []encodeDecimal{{2, 5}},
+		IP:     net.ParseIP("10.0.0.1"),
+		Ptr:    &encodeDecimal{3, 0},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.RegisterRawTypeEncoder(reflect.TypeOf(encodeDecimal{}),
+		func(v interface{}) ([]byte, error) {
+			d := v.(encodeDecimal)
+			return []byte(fmt.Sprintf("%d.%02d", d.units, d.cents)), nil
+		})
+	enc.RegisterTypeEncoder(reflect.TypeOf(net.IP{}),
+		func(v interface{}) ([]byte, error) {
+			return []byte("ip:" + v.(net.IP).String()), nil
+		})
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Price = 1.50\nPrices = [2.05]\nIP = \"ip:10.0.0.1\"\n" +
+		"Ptr = 3.00\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, got)
+	}
+
+	// An encoder registered for a pointer type is used for addressable
+	// values.
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	enc.RegisterTypeEncoder(reflect.TypeOf(&encodeDecimal{}),
+		func(v interface{}) ([]byte, error) {
+			return []byte(fmt.Sprintf("%d", v.(*encodeDecimal).units)), nil
+		})
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected = "Price = \"1\"\nPrices = [\"2\"]\nIP = \"10.0.0.1\"\n" +
+		"Ptr = \"3\"\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%q\nbut got\n%q", expected, got)
+	}
+}
+
+func TestEncodeFoldSingleTableArrays(t *testing.T) {
+	type item struct{ V int }
+	val := map[string]interface{}{
+		"one":  []item{{1}},
+		"two":  []*item{{2}, {3}},
+		"none": []item{},
+		"nested": map[string]interface{}{
+			"one": []map[string]int{{"v": 4}},
+		},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.FoldSingleTableArrays = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `none = []
+
+[nested]
+  [nested.one]
+    v = 4
+
+[one]
+  V = 1
+
+[[two]]
+  V = 2
+
+[[two]]
+  V = 3
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+func TestEncodeCanonical(t *testing.T) {
+	val := map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		val[fmt.Sprintf("key%d", i)] = float64(i) * 1e20
+		val[fmt.Sprintf("table%d", i)] = map[string]interface{}{
+			"a": i, "b": float32(i) / 8, "c": []int{i},
+		}
+	}
+
+	var first string
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.Canonical = true
+		enc.Indent = "\t\t"
+		if err := enc.Encode(val); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = buf.String()
+		} else if buf.String() != first {
+			t.Fatalf("encode %d differs from the first encode", i)
+		}
+	}
+	if strings.Contains(first, "\t") {
+		t.Errorf("Indent was not ignored in canonical form")
+	}
+	if !strings.Contains(first, "key1 = 100000000000000000000.0\n") {
+		t.Errorf("float not written in decimal notation:\n%s", first)
+	}
+	if !strings.Contains(first, "\n[table1]\n  a = 1\n  b = 0.125\n") {
+		t.Errorf("unexpected canonical output:\n%s", first)
+	}
+}
+
+func TestEncodeFractionalSeconds(t *testing.T) {
+	tests := map[string]struct {
+		nsec int
+		want string
+	}{
+		"whole second": {0, "T = 2014-05-11T19:30:40Z\n"},
+		"millisecond":  {500000000, "T = 2014-05-11T19:30:40.5Z\n"},
+		"microsecond":  {123456000, "T = 2014-05-11T19:30:40.123456Z\n"},
+		"nanosecond":   {123456789, "T = 2014-05-11T19:30:40.123456789Z\n"},
+	}
+	for label, test := range tests {
+		date := time.Date(2014, 5, 11, 20, 30, 40, test.nsec,
+			time.FixedZone("IST", 3600))
+		encodeExpected(t, label, struct{ T time.Time }{date}, test.want, nil)
+
+		var decoded struct{ T time.Time }
+		if _, err := Decode(test.want, &decoded); err != nil {
+			t.Errorf("%s: Decode failed: %s", label, err)
+			continue
+		}
+		if !decoded.T.Equal(date) {
+			t.Errorf("%s: want %v, got %v", label, date, decoded.T)
+		}
+	}
+}
+
+func TestEncodeDatetimeLayout(t *testing.T) {
+	date := time.Date(2014, 5, 11, 19, 30, 40, 500000000,
+		time.FixedZone("IST", 3600))
+	type event struct {
+		Day    time.Time   `datetime:"2006-01-02"`
+		Clock  time.Time   `datetime:"15:04:05.000"`
+		Local  time.Time   `datetime:"2006-01-02 15:04:05"`
+		Offset time.Time   `datetime:"2006-01-02T15:04:05Z07:00"`
+		Days   []time.Time `datetime:"2006-01-02"`
+		Plain  time.Time
+		Nested struct{ Time time.Time }
+	}
+	val := event{date, date, date, date, []time.Time{date}, date,
+		struct{ Time time.Time }{date}}
+	expected := `Day = 2014-05-11
+Clock = 19:30:40.500
+Local = 2014-05-11 19:30:40
+Offset = 2014-05-11T19:30:40+01:00
+Days = [2014-05-11]
+Plain = 2014-05-11T18:30:40.5Z
+
+[Nested]
+  Time = 2014-05-11T18:30:40.5Z
+`
+	encodeExpected(t, "datetime layouts", val, expected, nil)
+
+	// TOML 0.4 only has offset datetimes.
+	toml04 := []struct {
+		label   string
+		val     interface{}
+		wantErr bool
+	}{
+		{"offset datetime layout", struct {
+			Offset time.Time `datetime:"2006-01-02T15:04:05.000Z07:00"`
+		}{date}, false},
+		{"local date layout", struct {
+			Day time.Time `datetime:"2006-01-02"`
+		}{date}, true},
+		{"space", struct {
+			T time.Time `datetime:"2006-01-02 15:04:05Z07:00"`
+		}{date}, true},
+	}
+	for _, test := range toml04 {
+		enc := NewEncoder(ioutil.Discard)
+		enc.Spec = TOML04
+		if err := enc.Encode(test.val); (err != nil) != test.wantErr {
+			t.Errorf("%s in TOML 0.4: want error %t, got %v", test.label,
+				test.wantErr, err)
+		}
+	}
+
+	invalid := []interface{}{
+		struct {
+			T time.Time `datetime:"Jan 2, 2006"`
+		}{date},
+		struct {
+			T time.Time `datetime:"2006-1-2"`
+		}{date},
+		struct {
+			T time.Time `datetime:"3:04PM"`
+		}{date},
+	}
+	for _, val := range invalid {
+		encodeExpected(t, "invalid datetime layout", val, "", errAnything)
+	}
+}
+
+func TestEncodeTimeZone(t *testing.T) {
+	date := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := map[string]struct {
+		zone *time.Location
+		want string
+	}{
+		"east":        {time.FixedZone("", 7*3600), "2006-01-02T22:04:05+07:00"},
+		"west":        {time.FixedZone("", -(3*3600 + 1800)), "2006-01-02T11:34:05-03:30"},
+		"UTC":         {time.UTC, "2006-01-02T15:04:05Z"},
+		"zero offset": {time.FixedZone("GMT", 0), "2006-01-02T15:04:05Z"},
+	}
+	for label, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.TimeZone = test.zone
+		err := enc.Encode(struct {
+			T     time.Time
+			Times []time.Time
+			Later time.Time `datetime:"2006-01-02T15:04:05Z07:00"`
+		}{date, []time.Time{date}, date.Add(time.Second)})
+		if err != nil {
+			t.Errorf("%s: %s", label, err)
+			continue
+		}
+		expected := fmt.Sprintf("T = %s\nTimes = [%[1]s]\nLater = %s\n",
+			test.want, strings.Replace(test.want, ":05", ":06", 1))
+		if got := buf.String(); got != expected {
+			t.Errorf("%s: want %q, got %q", label, expected, got)
+		}
+	}
+}
+
+func TestEncodeJSONNumber(t *testing.T) {
+	tests := map[string]struct {
+		input      interface{}
+		wantOutput string
+		wantError  error
+	}{
+		"integer": {
+			input:      map[string]json.Number{"n": "-42"},
+			wantOutput: "n = -42\n",
+		},
+		"float": {
+			input: map[string]interface{}{
+				"a": json.Number("1.5"),
+				"b": json.Number("2e3"),
+			},
+			wantOutput: "a = 1.5\nb = 2000.0\n",
+		},
+		"array": {
+			input: struct {
+				Ints   []json.Number
+				Floats []interface{}
+			}{[]json.Number{"1", "2"}, []interface{}{json.Number("0.5"), 1.5}},
+			wantOutput: "Ints = [1, 2]\nFloats = [0.5, 1.5]\n",
+		},
+		"zero value": {
+			input: struct {
+				N json.Number
+				M map[string]json.Number
+			}{M: map[string]json.Number{"m": ""}},
+			wantOutput: "N = 0\n\n[M]\n  m = 0\n",
+		},
+		"(error) mixed array": {
+			input:     map[string][]json.Number{"a": {"1", "1.5"}},
+			wantError: errArrayMixedElementTypes,
+		},
+		"(error) malformed": {
+			input:     map[string]json.Number{"n": "12abc"},
+			wantError: errAnything,
+		},
+		"(error) out of range": {
+			input:     map[string]json.Number{"n": "9223372036854775808"},
+			wantError: errAnything,
+		},
+	}
+	for label, test := range tests {
+		encodeExpected(t, label, test.input, test.wantOutput, test.wantError)
+	}
+
+	var buf bytes.Buffer
+	val := struct {
+		T struct{ N json.Number }
+	}{}
+	val.T.N = "x"
+	err := NewEncoder(&buf).Encode(val)
+	if err == nil || !strings.Contains(err.Error(), "'T.N'") {
+		t.Errorf("want error for key 'T.N', got %v", err)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{"a\tb \"q\"", `"a\tb \"q\""`},
+		{"é", `"é"`},
+		{1.0, "1.0"},
+		{float32(0.1), "0.1"},
+		{1e21, "1000000000000000000000.0"},
+		{-7, "-7"},
+		{uint8(7), "7"},
+		{true, "true"},
+		{false, "false"},
+		{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "2020-01-02T03:04:05Z"},
+		{encodeVersion{1, 2}, `"1.2"`},
+		{encodeSecret("x"), `"***"`},
+		{json.Number("1.5"), "1.5"},
+	}
+	for _, test := range tests {
+		got, err := FormatValue(test.v)
+		if err != nil {
+			t.Errorf("%#v: %s", test.v, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%#v: want %s, got %s", test.v, test.want, got)
+		}
+	}
+
+	for _, v := range []interface{}{
+		nil, (*int)(nil), []int{1}, map[string]int{"a": 1}, struct{}{},
+	} {
+		if got, err := FormatValue(v); err == nil {
+			t.Errorf("%#v: expected error, got %s", v, got)
+		}
+	}
+}
+
+func TestFormatKey(t *testing.T) {
+	tests := []struct {
+		segment, want string
+	}{
+		{"a", "a"},
+		{"A_b-1", "A_b-1"},
+		{"1234", "1234"},
+		{"", `""`},
+		{"a.b", `"a.b"`},
+		{"a b", `"a b"`},
+		{"[a]", `"[a]"`},
+		{"a=b", `"a=b"`},
+		{"é", `"é"`},
+		{"a\"b", "\"a\\\"b\""},
+		{"a\"b\\c", `"a\"b\\c"`},
+		{"a\tb\n", `"a\tb\n"`},
+	}
+	for _, test := range tests {
+		if got := FormatKey(test.segment); got != test.want {
+			t.Errorf("%q: want %s, got %s", test.segment, test.want, got)
+		}
+	}
+
+	dotted := []struct {
+		parts []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"a"}, "a"},
+		{[]string{"a", "b c", "", "d.e"}, `a."b c".""."d.e"`},
+	}
+	for _, test := range dotted {
+		if got := FormatDottedKey(test.parts...); got != test.want {
+			t.Errorf("%q: want %s, got %s", test.parts, test.want, got)
+		}
+	}
+
+	// The encoder quotes keys just as FormatKey does.
+	type point struct{ X int }
+	val := map[string]interface{}{
+		"a/b":   1,
+		"i":     map[string]point{"c:d": {1}},
+		"t é":   map[string]int{"x+y": 2},
+		"rows@": []point{{3}},
+	}
+	encodeExpected(t, "quoted keys", val, `"a/b" = 1
+
+[i]
+  [i."c:d"]
+    X = 1
+
+[["rows@"]]
+  X = 3
+
+["t é"]
+  "x+y" = 2
+`, nil)
+	inline := struct {
+		I map[string]point `toml:"i/j,inline"`
+	}{map[string]point{"c:d": {1}}}
+	encodeExpected(t, "quoted inline keys", inline,
+		"\"i/j\" = { \"c:d\" = { X = 1 } }\n", nil)
+}
+
+func TestEncodeExplicitSign(t *testing.T) {
+	val := struct {
+		Int     int
+		Zero    int
+		Neg     int
+		Uint    uint8
+		Float   float64
+		FZero   float64
+		NegZero float64
+		FNeg    float32
+		Inf     float64
+		NegInf  float64
+		NaN     float64
+		List    []int
+		Number  json.Number
+		String  string
+	}{
+		5, 0, -5, 7, 1.5, 0, math.Copysign(0, -1), -2.5,
+		math.Inf(1), math.Inf(-1), math.NaN(), []int{1, -1, 0},
+		json.Number("42"), "5",
+	}
+	expected := `Int = +5
+Zero = +0
+Neg = -5
+Uint = +7
+Float = +1.5
+FZero = +0.0
+NegZero = -0.0
+FNeg = -2.5
+Inf = +inf
+NegInf = -inf
+NaN = nan
+List = [+1, -1, +0]
+Number = +42
+String = "5"
+`
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.ExplicitSign = true
+	enc.Spec = TOML10
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	// Canonical output never has a plus sign.
+	buf.Reset()
+	enc.Canonical = true
+	if err := enc.Encode(map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a = 1\n"; got != want {
+		t.Errorf("canonical: want %q, got %q", want, got)
+	}
+}
+
+type encodeErrorStruct struct{ Code int }
+
+func (e encodeErrorStruct) Error() string { return fmt.Sprintf("code %d", e.Code) }
+
+func TestEncodeErrorAsString(t *testing.T) {
+	type result struct {
+		Err    error
+		Nil    error
+		Struct encodeErrorStruct
+		Errs   []error
+	}
+	val := result{
+		Err:    errors.New("failed"),
+		Struct: encodeErrorStruct{2},
+		Errs:   []error{encodeErrorStruct{3}},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.ErrorAsString = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Err = \"failed\"\nStruct = \"code 2\"\nErrs = [\"code 3\"]\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("want %q, got %q", expected, got)
+	}
+
+	encodeExpected(t, "without ErrorAsString",
+		struct{ Err error }{encodeErrorStruct{2}}, "[Err]\n  Code = 2\n", nil)
+}
+
+func TestEncodeTopLevelKeyOrder(t *testing.T) {
+	val := map[string]interface{}{
+		"version": 1,
+		"name":    "x",
+		"extra":   true,
+		"another": 2,
+		"server":  map[string]int{"port": 1, "host": 2},
+		"client":  map[string]int{"b": 1},
+		"db":      map[string]int{"a": 1},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.TopLevelKeyOrder = []string{"version", "server", "name", "missing",
+		"db"}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `version = 1
+name = "x"
+another = 2
+extra = true
+
+[server]
+  host = 2
+  port = 1
+
+[db]
+  a = 1
+
+[client]
+  b = 1
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+func TestEncodeSpec(t *testing.T) {
+	val := struct {
+		NaN    float64
+		Inf    float32
+		NegInf []float64
+	}{math.NaN(), float32(math.Inf(1)), []float64{math.Inf(-1)}}
+	tests := map[Spec]string{
+		TOML05: "NaN = nan\nInf = inf\nNegInf = [-inf]\n",
+		TOML10: "NaN = nan\nInf = inf\nNegInf = [-inf]\n",
+	}
+	for spec, expected := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.Spec = spec
+		if err := enc.Encode(val); err != nil {
+			t.Errorf("spec %d: Encode failed: %s", spec, err)
+			continue
+		}
+		if got := buf.String(); got != expected {
+			t.Errorf("spec %d: want %q, got %q", spec, expected, got)
+		}
+	}
+
+	encodeExpected(t, "nan by default", struct{ F float64 }{math.NaN()}, "",
+		errAnything)
+	encodeExpected(t, "inf by default", struct{ F []float64 }{
+		[]float64{math.Inf(1)},
+	}, "", errAnything)
+	enc := NewEncoder(ioutil.Discard)
+	enc.Spec = TOML04
+	if err := enc.Encode(val); err == nil {
+		t.Error("nan in TOML 0.4: want error, got nil")
+	}
+}
+
+func TestEncodeAllowMixedArrays(t *testing.T) {
+	type table struct{ V int }
+	tests := map[string]struct {
+		input      interface{}
+		spec       Spec
+		wantOutput string
+		wantError  error
+	}{
+		"primitives": {
+			input: map[string]interface{}{
+				"a": []interface{}{1, "two", true, 1.5},
+			},
+			spec:       TOML10,
+			wantOutput: "a = [1, \"two\", true, 1.5]\n",
+		},
+		"nested arrays": {
+			input: map[string]interface{}{
+				"a": []interface{}{1, []interface{}{"x", 2}, []int{}},
+			},
+			spec:       TOML10,
+			wantOutput: "a = [1, [\"x\", 2], []]\n",
+		},
+		"(error) table and primitive": {
+			input: map[string]interface{}{
+				"a": []interface{}{table{1}, 2},
+			},
+			spec:      TOML10,
+			wantError: errArrayMixedElementTypes,
+		},
+		"(error) nested array of tables": {
+			input: map[string]interface{}{
+				"a": []interface{}{1, []table{{1}}},
+			},
+			spec:      TOML10,
+			wantError: errArrayNoTable,
+		},
+		"(error) TOML 0.5": {
+			input: map[string]interface{}{
+				"a": []interface{}{1, "two"},
+			},
+			spec:      TOML05,
+			wantError: errArrayMixedElementTypes,
+		},
+	}
+	for label, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.Spec = test.spec
+		enc.AllowMixedArrays = true
+		err := enc.Encode(test.input)
+		if underlying(err) != test.wantError {
+			t.Errorf("%s: want error %v, got %v", label, test.wantError, err)
+			continue
+		}
+		if got := buf.String(); got != test.wantOutput {
+			t.Errorf("%s: want %q, got %q", label, test.wantOutput, got)
+		}
+	}
+}
+
+func TestEncodeManual(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Header = "generated"
+	steps := []func() error{
+		func() error { return enc.WriteKeyValue(NewKey("title"), "x") },
+		func() error { return enc.WriteComment("The owner.\nSecond line.") },
+		func() error { return enc.WriteTableHeader(NewKey("owner")) },
+		func() error {
+			return enc.WriteKeyValue(NewKey("owner", "ports"), []int{1, 2})
+		},
+		func() error { return enc.WriteArrayTableHeader(NewKey("owner", "pets")) },
+		func() error {
+			return enc.WriteKeyValue(NewKey("owner", "pets", "name"), "rex")
+		},
+		func() error { return enc.WriteTableHeader(NewKey("other")) },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+	}
+	expected := `# generated
+
+title = "x"
+# The owner.
+# Second line.
+
+[owner]
+  ports = [1, 2]
+
+  [[owner.pets]]
+    name = "rex"
+
+[other]
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	if err := enc.WriteKeyValue(NewKey("t"), map[string]int{}); err == nil {
+		t.Error("expected error writing a table with WriteKeyValue")
+	}
+	if err := enc.WriteKeyValue(NewKey("n"), nil); err == nil {
+		t.Error("expected error writing nil with WriteKeyValue")
+	}
+	if err := enc.WriteTableHeader(NewKey()); underlying(err) != errNoKey {
+		t.Errorf("want error %v, got %v", errNoKey, err)
+	}
+}
+
+func TestEncodeEmbeddedPointer(t *testing.T) {
+	type Inner struct{ I int }
+	type Base struct {
+		B int
+		*Inner
+	}
+	type conf struct {
+		*Base
+		Name string
+	}
+	encodeExpected(t, "nil embedded pointer", conf{Name: "x"},
+		"Name = \"x\"\n", nil)
+	encodeExpected(t, "embedded pointer", conf{&Base{B: 1}, "x"},
+		"B = 1\nName = \"x\"\n", nil)
+	encodeExpected(t, "nested embedded pointers",
+		conf{&Base{1, &Inner{2}}, "x"}, "B = 1\nI = 2\nName = \"x\"\n", nil)
+	encodeExpected(t, "nil embedded pointer in inline table", struct {
+		T conf `toml:",inline"`
+	}{conf{Name: "x"}}, "T = { Name = \"x\" }\n", nil)
+}
+
+func TestEncodeNamedEmbeddedStruct(t *testing.T) {
+	type Meta struct {
+		Version int
+	}
+	type Labels map[string]string
+	type flattened struct {
+		Meta
+		Name string
+	}
+	type named struct {
+		Meta   `toml:"meta"`
+		Labels `toml:"labels"`
+		Name   string
+	}
+	encodeExpected(t, "flattened", flattened{Meta{1}, "x"},
+		"Version = 1\nName = \"x\"\n", nil)
+	encodeExpected(t, "named", named{Meta{1}, Labels{"a": "b"}, "x"},
+		"Name = \"x\"\n\n[meta]\n  Version = 1\n\n[labels]\n  a = \"b\"\n",
+		nil)
+	encodeExpected(t, "named inline", struct {
+		T named `toml:",inline"`
+	}{named{Meta: Meta{1}, Name: "x"}},
+		"T = { meta = { Version = 1 }, Name = \"x\" }\n", nil)
+}
+
+func TestKeysOf(t *testing.T) {
+	type Base struct {
+		ID      int
+		Created time.Time
+	}
+	type server struct {
+		Host string `toml:"host"`
+		Port int    `toml:"port,omitempty"`
+	}
+	type node struct {
+		Name string
+		Next *node
+	}
+	type conf struct {
+		Base
+		Title   string `toml:"title"`
+		Secret  string `toml:"-"`
+		private int
+		Owner   *server           `toml:"owner"`
+		Servers []server          `toml:"servers"`
+		Labels  map[string]string `toml:"labels"`
+		Node    node
+		Meta    Base `toml:"meta"`
+	}
+	keys, err := KeysOf(reflect.TypeOf(&conf{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, k := range keys {
+		got = append(got, k.String())
+	}
+	want := []string{
+		"ID", "Created", "title",
+		"owner", "owner.host", "owner.port",
+		"servers", "servers.host", "servers.port",
+		"labels",
+		"Node", "Node.Name", "Node.Next",
+		"meta", "meta.ID", "meta.Created",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want\n%q\nbut got\n%q", want, got)
+	}
+
+	// The Encoder's options apply.
+	type tagged struct {
+		Name  string `json:"name"`
+		Skip  string `json:"-"`
+		Owner server `json:"owner"`
+	}
+	enc := NewEncoder(ioutil.Discard)
+	enc.UseJSONTagFallback = true
+	enc.KeyCase = CaseUpper
+	keys, err = enc.KeysOf(reflect.TypeOf(tagged{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, k := range keys {
+		got = append(got, k.String())
+	}
+	want = []string{"NAME", "OWNER", "OWNER.HOST", "OWNER.PORT"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Encoder options: want\n%q\nbut got\n%q", want, got)
+	}
+
+	if _, err := KeysOf(reflect.TypeOf(1)); err == nil {
+		t.Error("expected error for a non-struct type")
+	}
+	type Ints []int
+	_, err = KeysOf(reflect.TypeOf(struct{ Ints }{}))
+	if err != errAnonNonStruct {
+		t.Errorf("want error %v, got %v", errAnonNonStruct, err)
+	}
+}
+
+func TestEncodeArrayTableWriter(t *testing.T) {
+	type record struct {
+		ID   int
+		Tags []string
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.WriteKeyValue(NewKey("title"), "export"); err != nil {
+		t.Fatal(err)
+	}
+	w := enc.BeginArrayTable(NewKey("records"))
+	for i := 1; i <= 3; i++ {
+		if err := w.Append(&record{i, []string{"t"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Append(map[string]int{"ID": 4}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `title = "export"
+
+[[records]]
+  ID = 1
+  Tags = ["t"]
+
+[[records]]
+  ID = 2
+  Tags = ["t"]
+
+[[records]]
+  ID = 3
+  Tags = ["t"]
+
+[[records]]
+  ID = 4
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	var decoded struct{ Records []record }
+	if _, err := Decode(buf.String(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Records) != 4 {
+		t.Errorf("want 4 records, got %d", len(decoded.Records))
+	}
+
+	if err := w.Append(1); err == nil {
+		t.Error("expected error appending a non-table")
+	}
+	err := enc.BeginArrayTable(NewKey()).Append(record{})
+	if underlying(err) != errNoKey {
+		t.Errorf("want error %v, got %v", errNoKey, err)
+	}
+}
+
+func TestEncodeStream(t *testing.T) {
+	type record struct{ ID int }
+	ch := make(chan interface{})
+	go func() {
+		defer close(ch)
+		for i := 1; i <= 2; i++ {
+			ch <- record{i}
+		}
+		ch <- map[string]string{"Name": "x"}
+	}()
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.EncodeStream(NewKey("records"), ch); err != nil {
+		t.Fatal(err)
+	}
+	expected := `[[records]]
+  ID = 1
+
+[[records]]
+  ID = 2
+
+[[records]]
+  Name = "x"
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	// The first value that isn't a table stops the stream, and the values
+	// after it aren't received.
+	buf.Reset()
+	ch = make(chan interface{}, 3)
+	ch <- record{1}
+	ch <- 2
+	ch <- record{3}
+	close(ch)
+	enc = NewEncoder(&buf)
+	if err := enc.EncodeStream(NewKey("records"), ch); err == nil {
+		t.Error("expected error streaming a non-table")
+	}
+	if got, want := buf.String(), "[[records]]\n  ID = 1\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if n := len(ch); n != 1 {
+		t.Errorf("want 1 value left in the channel, got %d", n)
+	}
+}
+
+func TestEncodeUnder(t *testing.T) {
+	type sub struct{ C int }
+	type conf struct {
+		Name string
+		Sub  sub
+		Rows []sub
+	}
+	val := conf{Name: "x", Sub: sub{1}, Rows: []sub{{2}}}
+	tests := []struct {
+		prefix   Key
+		val      interface{}
+		expected string
+	}{
+		{NewKey("a", "b"), val, `  [a.b]
+    Name = "x"
+    [a.b.Sub]
+      C = 1
+
+    [[a.b.Rows]]
+      C = 2
+`},
+		{NewKey("a b"), map[string]int{"k": 1}, "[\"a b\"]\n  k = 1\n"},
+		{NewKey("a/b", "é"), map[string]int{"k": 1},
+			"  [\"a/b\".\"é\"]\n    k = 1\n"},
+		{NewKey("a", "b"), []sub{{1}, {2}},
+			"  [[a.b]]\n    C = 1\n\n  [[a.b]]\n    C = 2\n"},
+		{NewKey(), sub{1}, "C = 1\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).EncodeUnder(test.prefix, test.val); err != nil {
+			t.Errorf("%s: EncodeUnder failed: %s", test.prefix, err)
+			continue
+		}
+		if got := buf.String(); got != test.expected {
+			t.Errorf("%s: want\n%s\nbut got\n%s", test.prefix, test.expected,
+				got)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).EncodeUnder(NewKey("a"), 1); err == nil {
+		t.Errorf("want error for a value that isn't a table")
+	}
+	enc := NewEncoder(&buf)
+	enc.StrictKeys = true
+	if err := enc.EncodeUnder(NewKey("a", " "), val); err == nil {
+		t.Errorf("want error for a blank prefix with StrictKeys")
+	}
+	enc = NewEncoder(&buf)
+	enc.SingleLine = true
+	if err := enc.EncodeUnder(NewKey("a"), val); underlying(err) !=
+		errSingleLinePrefix {
+		t.Errorf("SingleLine: want error %v, got %v", errSingleLinePrefix,
+			err)
+	}
+}
+
+func TestEncodeEmitParentTables(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EmitParentTables = true
+	steps := []func() error{
+		func() error { return enc.WriteTableHeader(NewKey("a", "b", "c")) },
+		func() error { return enc.WriteKeyValue(NewKey("a", "b", "c", "k"), 1) },
+		func() error { return enc.WriteComment("servers") },
+		func() error { return enc.WriteArrayTableHeader(NewKey("a", "s")) },
+		func() error { return enc.WriteArrayTableHeader(NewKey("a", "s")) },
+		func() error { return enc.WriteTableHeader(NewKey("a", "b", "d")) },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+	}
+	expected := `[a]
+  [a.b]
+    [a.b.c]
+      k = 1
+# servers
+
+  [[a.s]]
+
+  [[a.s]]
+    [a.b.d]
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	// Encode writes every parent table anyway.
+	val := map[string]interface{}{
+		"a": map[string]interface{}{"b": map[string]int{"c": 1}},
+	}
+	expected = "[a]\n  [a.b]\n    c = 1\n"
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	enc.EmitParentTables = true
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != expected {
+		t.Errorf("Encode: want\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+func TestEncodeFixedSizeArrays(t *testing.T) {
+	type conf struct {
+		Empty   [0]int
+		One     [1]string
+		Ints    [3]int
+		Floats  [2][2]float64
+		Ragged  [2][]int
+		Mixed   [2]interface{}
+		Tables  [2]struct{ N int }
+		NoTable [0]struct{ N int }
+	}
+	val := conf{
+		One:    [1]string{"a"},
+		Ints:   [3]int{1, 2, 3},
+		Floats: [2][2]float64{{1, 2.5}, {3, 4}},
+		Ragged: [2][]int{{1}, {}},
+		Mixed:  [2]interface{}{int8(1), uint(2)},
+		Tables: [2]struct{ N int }{{1}, {2}},
+	}
+	encodeExpected(t, "fixed-size arrays", val, `Empty = []
+One = ["a"]
+Ints = [1, 2, 3]
+Floats = [[1.0, 2.5], [3.0, 4.0]]
+Ragged = [[1], []]
+Mixed = [1, 2]
+NoTable = []
+
+[[Tables]]
+  N = 1
+
+[[Tables]]
+  N = 2
+`, nil)
+
+	// The same checks apply as to slices.
+	encodeExpected(t, "mixed array", map[string][2]interface{}{
+		"a": {1, "b"},
+	}, "", errArrayMixedElementTypes)
+	encodeExpected(t, "nil element", map[string][2]*int{"a": {}}, "",
+		errAnything)
+	encodeExpected(t, "nested tables", map[string][1][1]struct{}{"a": {}}, "",
+		errAnything)
+}
+
+func TestEncodeArrayStyle(t *testing.T) {
+	val := map[string]interface{}{
+		"table": map[string]interface{}{
+			"nested": [][]int{{1, 2}, {}, {3}},
+			"empty":  []int{},
+			"long": []string{
+				"aaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbb",
+				"cccccccccccccccccccc", "dddddddddddddddddddd",
+			},
+		},
+	}
+	tests := map[ArrayStyle]string{
+		ArrayCompact: `[table]
+  empty = []
+  long = ["aaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbb", "cccccccccccccccccccc", "dddddddddddddddddddd"]
+  nested = [[1, 2], [], [3]]
+`,
+		ArrayExpanded: `[table]
+  empty = []
+  long = [
+    "aaaaaaaaaaaaaaaaaaaa",
+    "bbbbbbbbbbbbbbbbbbbb",
+    "cccccccccccccccccccc",
+    "dddddddddddddddddddd"
+  ]
+  nested = [
+    [
+      1,
+      2
+    ],
+    [],
+    [
+      3
+    ]
+  ]
+`,
+		ArrayAuto: `[table]
+  empty = []
+  long = [
+    "aaaaaaaaaaaaaaaaaaaa",
+    "bbbbbbbbbbbbbbbbbbbb",
+    "cccccccccccccccccccc",
+    "dddddddddddddddddddd"
+  ]
+  nested = [[1, 2], [], [3]]
+`,
+	}
+	for style, expected := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		if err := enc.SetArrayStyle(style); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(val); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != expected {
+			t.Errorf("style %d: want\n%s\nbut got\n%s", style, expected, got)
+		}
+
+		var decoded map[string]interface{}
+		if _, err := Decode(buf.String(), &decoded); err != nil {
+			t.Errorf("style %d: Decode failed: %s", style, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.ArrayStyle = ArrayAuto
+	enc.ArrayWidth = 20
+	if err := enc.Encode(map[string][]int{"abc": {1, 2, 3, 4, 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "abc = [\n  1,\n  2,\n  3,\n  4,\n  5\n]\n"; got != want {
+		t.Errorf("auto with width 20: want %q, got %q", want, got)
+	}
+
+	if err := enc.SetArrayStyle(ArrayStyle(42)); err != errInvalidArrayStyle {
+		t.Errorf("want error %v, got %v", errInvalidArrayStyle, err)
+	}
+}
+
+func TestEncodeSingleLine(t *testing.T) {
+	type server struct {
+		Host  string
+		Ports []int
+	}
+	type conf struct {
+		Title   string    `comment:"ignored"`
+		Text    string    `modifier:"multiline_string"`
+		Port    int       `toml:",string"`
+		Day     time.Time `datetime:"2006-01-02"`
+		Initial rune      `modifier:"rune"`
+		Owner   struct{ Name string }
+		Servers []server
+		Labels  map[string]map[string]int
+		Empty   map[string]int
+		Nil     *server
+	}
+	val := conf{
+		Title:   "t",
+		Text:    "a\nb",
+		Port:    80,
+		Day:     time.Date(2014, 5, 11, 19, 30, 40, 0, time.UTC),
+		Initial: 'x',
+		Owner:   struct{ Name string }{"o"},
+		Servers: []server{{"a", []int{1, 2}}, {"b", nil}},
+		Labels:  map[string]map[string]int{"x": {"y": 1}},
+		Empty:   map[string]int{},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SingleLine = true
+	enc.ArrayStyle = ArrayExpanded
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Title = "t"
+Text = "a\nb"
+Port = "80"
+Day = 2014-05-11
+Initial = "x"
+Owner = { Name = "o" }
+Servers = [{ Host = "a", Ports = [1, 2] }, { Host = "b" }]
+Labels = { x = { y = 1 } }
+Empty = {}
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("want\n%s\nbut got\n%s", expected, got)
+	}
+
+	enc = NewEncoder(ioutil.Discard)
+	enc.SingleLine = true
+	err := enc.Encode(struct {
+		T time.Time `datetime:"Jan 2"`
+	}{})
+	if err == nil || !strings.Contains(err.Error(), "'T'") {
+		t.Errorf("invalid datetime layout: want error for key 'T', got %v",
+			err)
+	}
+	if err := enc.Encode([]int{1}); underlying(err) != errNoKey {
+		t.Errorf("want error %v, got %v", errNoKey, err)
+	}
+}
+
+func TestEncodeTrailingComma(t *testing.T) {
+	val := map[string]interface{}{
+		"long":   []string{"aaaaaaaaaa", "bbbbbbbbbb"},
+		"nested": [][]int{{1, 2}, {3, 4, 5, 6, 7, 8, 9}},
+		"short":  []int{1, 2},
+	}
+	tests := []struct {
+		trailing bool
+		expected string
+	}{
+		{false, `long = [
+  "aaaaaaaaaa",
+  "bbbbbbbbbb"
+]
+nested = [
+  [1, 2],
+  [3, 4, 5, 6, 7, 8, 9]
+]
+short = [1, 2]
+`},
+		{true, `long = [
+  "aaaaaaaaaa",
+  "bbbbbbbbbb",
+]
+nested = [
+  [1, 2],
+  [3, 4, 5, 6, 7, 8, 9],
+]
+short = [1, 2]
+`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.ArrayStyle = ArrayAuto
+		enc.ArrayWidth = 24
+		enc.TrailingComma = test.trailing
+		if err := enc.Encode(val); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != test.expected {
+			t.Errorf("TrailingComma %v: want\n%s\nbut got\n%s",
+				test.trailing, test.expected, got)
+		}
+
+		var decoded map[string]interface{}
+		if _, err := Decode(buf.String(), &decoded); err != nil {
+			t.Errorf("TrailingComma %v: Decode failed: %s", test.trailing,
+				err)
+		}
+	}
+}
+
+func TestEncodeOnKeyValue(t *testing.T) {
+	type conf struct {
+		Name    string
+		Port    int `toml:",string"`
+		Ratio   float64
+		Debug   bool
+		Start   time.Time
+		Tags    []string           `modifier:"multiline_string"`
+		Point   struct{ X, Y int } `toml:",inline"`
+		Secret  string
+		Servers map[string]struct{ IP string }
+	}
+	val := conf{
+		Name:    "a\tb",
+		Port:    8080,
+		Ratio:   0.5,
+		Debug:   true,
+		Start:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Tags:    []string{"x"},
+		Secret:  "hunter2",
+		Servers: map[string]struct{ IP string }{"alpha": {"10.0.0.1"}},
+	}
+
+	var got []string
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.ArrayStyle = ArrayExpanded
+	enc.RedactKeys = map[string]string{"Secret": "***"}
+	enc.OnKeyValue = func(key Key, tomlType string, rendered string) {
+		got = append(got, fmt.Sprintf("%s %s %s", key, tomlType, rendered))
+	}
+	if err := enc.Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`Name String "a\tb"`,
+		`Port String "8080"`,
+		`Ratio Float 0.5`,
+		`Debug Bool true`,
+		`Start Datetime 2020-01-02T03:04:05Z`,
+		"Tags Array [\n  \"\"\"\nx\"\"\"\n]",
+		`Point Hash { X = 0, Y = 0 }`,
+		`Secret String "***"`,
+		`Servers.alpha.IP String "10.0.0.1"`,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("want\n%s\ngot\n%s", strings.Join(expected, "\n"),
+			strings.Join(got, "\n"))
+	}
+}
+
+func TestEncodeInlineTables(t *testing.T) {
+	type point struct {
+		X, Y int
+		Z    *int `toml:",omitempty"`
+	}
+	type conf struct {
+		Name   string
+		Point  point                  `toml:"point,inline"`
+		Ptr    *point                 `toml:"ptr,inline"`
+		Nested map[string]interface{} `toml:"nested,inline"`
+		Empty  struct{}               `toml:"empty,inline"`
+		Long   map[string]string      `toml:"long,inline"`
+		Table  point                  `toml:"table"`
+	}
+	val := conf{
+		Name:  "x",
+		Point: point{X: 1, Y: 2},
+		Ptr:   &point{X: 3},
+		Nested: map[string]interface{}{
+			"a":    map[string]int{"b": 1},
+			"list": []point{{X: 1}, {Y: 2}},
+			"nil":  nil,
+		},
+		Long: map[string]string{
+			"key": strings.Repeat("v", 70),
+		},
+	}
+	expected := `Name = "x"
+point = { X = 1, Y = 2 }
+ptr = { X = 3, Y = 0 }
+nested = { a = { b = 1 }, list = [{ X = 1, Y = 0 }, { X = 0, Y = 2 }] }
+empty = {}
+
+[long]
+  key = "` + strings.Repeat("v", 70) + `"
+
+[table]
+  X = 0
+  Y = 0
+`
+	encodeExpected(t, "inline tables", val, expected, nil)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.InlineTableWidth = 20
+	if err := enc.Encode(struct {
+		A point `toml:"a,inline"`
+		B point `toml:"b,inline"`
+	}{point{X: 1}, point{X: 100000}}); err != nil {
+		t.Fatal(err)
+	}
+	expected = "a = { X = 1, Y = 0 }\n\n[b]\n  X = 100000\n  Y = 0\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("InlineTableWidth: want\n%s\nbut got\n%s", expected, got)
+	}
+
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = cyclic
+	encodeExpected(t, "cycle", struct {
+		C map[string]interface{} `toml:",inline"`
+	}{cyclic}, "", errAnything)
+}
+
+func TestEncodeEmbeddedTOML(t *testing.T) {
+	type plugin struct {
+		Name string
+		Opts map[string]int
+	}
+	type config struct {
+		Plugin plugin      `modifier:"embedded_toml"`
+		Bad    interface{} `modifier:"embedded_toml"`
+		After  int
+	}
+
+	encodeExpected(t, "embedded struct",
+		config{Plugin: plugin{Name: "x", Opts: map[string]int{"a": 1}}, After: 2},
+		"Plugin = \"Name = \\\"x\\\"\\n\\n[Opts]\\n  a = 1\\n\"\nAfter = 2\n", nil)
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(config{Bad: map[float64]int{1: 1}})
+	if err == nil || !strings.Contains(err.Error(), "'Bad'") {
+		t.Errorf("want sub-encoder error for key 'Bad', got %v", err)
+	}
+
+	var decoded struct{ Plugin string }
+	if _, err := Decode("Plugin = \"Name = \\\"x\\\"\\n\"", &decoded); err != nil {
+		t.Fatal(err)
+	}
+	var p plugin
+	if _, err := Decode(decoded.Plugin, &p); err != nil || p.Name != "x" {
+		t.Errorf("decoding embedded document: got %+v, %v", p, err)
+	}
+}
+
+func TestEncodeHeader(t *testing.T) {
+	tests := map[string]struct {
+		input      interface{}
+		wantOutput string
+	}{
+		"key first": {
+			input:      map[string]int{"a": 1},
+			wantOutput: "# Generated by mytool\n#\n# Do not edit.\n\na = 1\n",
+		},
+		"table first": {
+			input: map[string]interface{}{
+				"t": map[string]int{"a": 1},
+			},
+			wantOutput: "# Generated by mytool\n#\n# Do not edit.\n\n[t]\n  a = 1\n",
+		},
+		"array of tables first": {
+			input: map[string]interface{}{
+				"t": []map[string]int{{"a": 1}},
+			},
+			wantOutput: "# Generated by mytool\n#\n# Do not edit.\n\n[[t]]\n  a = 1\n",
+		},
+	}
+	for label, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.Header = "Generated by mytool\n\nDo not edit.\n"
+		if err := enc.Encode(test.input); err != nil {
+			t.Errorf("%s: Encode failed: %s", label, err)
+			continue
+		}
+		if got := buf.String(); got != test.wantOutput {
+			t.Errorf("%s: want\n%q\nbut got\n%q", label, test.wantOutput, got)
+		}
+	}
+}
+
+func TestEncodeSchemaComment(t *testing.T) {
+	const schema = "https://example.com/schema.json"
+	val := map[string]interface{}{
+		"t": map[string]int{"a": 1},
+	}
+	tests := map[string]struct {
+		header     string
+		wantOutput string
+	}{
+		"without header": {
+			wantOutput: "#:schema " + schema + "\n\n[t]\n  a = 1\n",
+		},
+		"with header": {
+			header: "Generated",
+			wantOutput: "#:schema " + schema + "\n# Generated\n\n" +
+				"[t]\n  a = 1\n",
+		},
+	}
+	for label, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SchemaComment = schema
+		enc.Header = test.header
+		if err := enc.Encode(val); err != nil {
+			t.Errorf("%s: Encode failed: %s", label, err)
+			continue
+		}
+		// The comments are only written at the start of the document.
+		if err := enc.WriteTableHeader(NewKey("u")); err != nil {
+			t.Errorf("%s: WriteTableHeader failed: %s", label, err)
+			continue
+		}
+		want := test.wantOutput + "\n[u]\n"
+		if got := buf.String(); got != want {
+			t.Errorf("%s: want\n%q\nbut got\n%q", label, want, got)
+		}
+	}
+
+	// Embedded documents don't repeat the directive.
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SchemaComment = schema
+	err := enc.Encode(struct {
+		Doc struct{ A int } `modifier:"embedded_toml"`
+	}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#:schema " + schema + "\n\nDoc = \"A = 0\\n\"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("embedded_toml: want %q, got %q", want, got)
+	}
+
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	enc.SchemaComment = "a\nb"
+	if err := enc.Encode(val); underlying(err) != errSchemaNewline {
+		t.Errorf("want error %v, got %v", errSchemaNewline, err)
+	}
+}
+
+func encodeExpected(
+	t *testing.T, label string, val interface{}, wantStr string, wantErr error,
+) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	err := enc.Encode(val)
+	if underlying(err) != wantErr {
+		if wantErr != nil {
+			if wantErr == errAnything && err != nil {
+				return
+			}
+			t.Errorf("%s: want Encode error %v, got %v", label, wantErr, err)
+		} else {
+			t.Errorf("%s: Encode failed: %s", label, err)
+		}
+	}
+	if err != nil {
+		return
+	}
+	if got := buf.String(); wantStr != got {
+		t.Errorf("%s: want\n-----\n%q\n-----\nbut got\n-----\n%q\n-----\n",
+			label, wantStr, got)
+	}
+}
+
+// underlying returns the error wrapped by an *EncodeError, or err itself.
+func underlying(err error) error {
+	if err, ok := err.(*EncodeError); ok {
+		return err.Err
+	}
+	return err
+}
+
+func TestEncodePrimitiveMapFastPath(t *testing.T) {
+	type name string
+	tests := map[string]interface{}{
+		"strings": map[string]string{"b": "x\ny", "a": "", "c d": "z"},
+		"ints":    map[string]int{"one": 1, "two": 2, "minus": -3},
+		"floats":  map[string]float64{"pi": 3.14, "one": 1},
+		"bools":   map[string]bool{"t": true, "f": false},
+		"named":   map[name]uint8{"b": 1, "a": 2},
+		"nested": map[string]interface{}{
+			"t": map[string]int{"a": 1}, "u": map[string]int{},
+		},
+		"status": map[string]encodeStatus{"s": 1},
+	}
+	for label, val := range tests {
+		var fast, slow bytes.Buffer
+		for _, canonical := range []bool{false, true} {
+			enc := NewEncoder(&fast)
+			enc.Canonical, enc.EnumAsString = canonical, true
+			enc.BoolAsString = &[2]string{"yes", "no"}
+			enc.TopLevelKeyOrder = []string{"two", "c d"}
+			if err := enc.Encode(val); err != nil {
+				t.Fatalf("%s: %s", label, err)
+			}
+			enc = NewEncoder(&slow)
+			enc.Canonical, enc.EnumAsString = canonical, true
+			enc.BoolAsString = &[2]string{"yes", "no"}
+			enc.TopLevelKeyOrder = []string{"two", "c d"}
+			enc.noFastPath = true
+			if err := enc.Encode(val); err != nil {
+				t.Fatalf("%s: %s", label, err)
+			}
+		}
+		if fast.String() != slow.String() {
+			t.Errorf("%s: fast path wrote\n%s\nbut eMap wrote\n%s", label,
+				fast.String(), slow.String())
+		}
+	}
+}
+
+// encodeSymbol is a map key type whose String method returns keys that can't
+// be written bare.
+type encodeSymbol int
+
+func (s encodeSymbol) String() string {
+	return [...]string{"a/b", "it's", "é", "a:b"}[s]
+}
+
+func TestEncodeNonStringMapKeys(t *testing.T) {
+	date := time.Date(2014, 5, 6, 7, 8, 9, 0, time.UTC)
+	tests := map[string]struct {
+		input      interface{}
+		wantOutput string
+		wantError  error
+	}{
+		"Stringer": {
+			input:      map[encodeStatus]int{1: 2, 0: 3},
+			wantOutput: "active = 2\ninactive = 3\n",
+		},
+		"TextMarshaler": {
+			input:      map[time.Time]string{date: "x"},
+			wantOutput: "\"2014-05-06T07:08:09Z\" = \"x\"\n",
+		},
+		"ints": {
+			input:      map[int]string{10: "a", 2: "b", -1: "c"},
+			wantOutput: "-1 = \"c\"\n10 = \"a\"\n2 = \"b\"\n",
+		},
+		"uints in tables": {
+			input: map[string]map[uint8]interface{}{
+				"t": {1: map[string]int{"a": 1}, 2: true},
+			},
+			wantOutput: "[t]\n  2 = true\n  [t.1]\n    a = 1\n",
+		},
+		"Stringer keys quoted": {
+			input: map[encodeSymbol]interface{}{
+				0: 1, 1: 2, 2: 3, 3: map[string]int{"k": 4},
+			},
+			wantOutput: "\"a/b\" = 1\n\"it's\" = 2\n\"é\" = 3\n\n" +
+				"[\"a:b\"]\n  k = 4\n",
+		},
+		"(error) duplicate Stringer keys": {
+			input:     map[encodeStatus]int{2: 1, 3: 1},
+			wantError: errDuplicateKey,
+		},
+	}
+	for label, test := range tests {
+		encodeExpected(t, label, test.input, test.wantOutput, test.wantError)
+	}
+}
+
+func TestEncodeBlankKeys(t *testing.T) {
+	val := map[string]interface{}{
+		"":    1,
+		"  ":  2,
+		"a b": 3,
+		"t":   map[string]interface{}{" ": map[string]int{"": 4}},
+		"i":   struct{ M map[string]int }{map[string]int{"": 5}},
+	}
+	expected := `"" = 1
+"  " = 2
+"a b" = 3
+
+[i]
+  [i.M]
+    "" = 5
+
+[t]
+  [t." "]
+    "" = 4
+`
+	encodeExpected(t, "blank keys", val, expected, nil)
+
+	inline := struct {
+		T map[string]int `toml:",inline"`
+	}{map[string]int{"": 1, "a": 2}}
+	encodeExpected(t, "blank inline table key", inline,
+		"T = { \"\" = 1, a = 2 }\n", nil)
+
+	tests := map[string]interface{}{
+		"empty key":      map[string]int{"": 1},
+		"whitespace key": map[string]int{" \t": 1},
+		"empty table":    map[string]interface{}{"": map[string]int{"a": 1}},
+		"whitespace table": map[string]interface{}{
+			"t": map[string]interface{}{" ": map[string]int{"a": 1}},
+		},
+		"inline table": inline,
+	}
+	for label, v := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.StrictKeys = true
+		err := enc.Encode(v)
+		if err == nil || !strings.HasPrefix(underlying(err).Error(),
+			errBlankKey.Error()) {
+			t.Errorf("%s: want error %v, got %v", label, errBlankKey, err)
+		}
+	}
+}
+
+func TestEncodeKeyCase(t *testing.T) {
+	type server struct {
+		HostName string
+		IPs      []string `toml:"IPs"`
+	}
+	type conf struct {
+		Title   string
+		Point   struct{ X, Y int } `toml:",inline"`
+		Labels  map[string]string
+		Servers []server
+		Meta    map[string]map[string]int
+	}
+	val := conf{
+		Title:   "a",
+		Labels:  map[string]string{"Zone": "b", "app": "c", "Has Space": "d"},
+		Servers: []server{{"h", []string{"10.0.0.1"}}},
+		Meta:    map[string]map[string]int{"Sub": {"N": 1}},
+	}
+	tests := []struct {
+		c        KeyCase
+		expected string
+	}{
+		{CaseNone, `Title = "a"
+Point = { X = 0, Y = 0 }
+
+[Labels]
+  "Has Space" = "d"
+  Zone = "b"
+  app = "c"
+
+[[Servers]]
+  HostName = "h"
+  IPs = ["10.0.0.1"]
+
+[Meta]
+  [Meta.Sub]
+    N = 1
+`},
+		{CaseLower, `title = "a"
+point = { x = 0, y = 0 }
+
+[labels]
+  app = "c"
+  "has space" = "d"
+  zone = "b"
+
+[[servers]]
+  hostname = "h"
+  ips = ["10.0.0.1"]
+
+[meta]
+  [meta.sub]
+    n = 1
+`},
+		{CaseUpper, `TITLE = "a"
+POINT = { X = 0, Y = 0 }
+
+[LABELS]
+  APP = "c"
+  "HAS SPACE" = "d"
+  ZONE = "b"
+
+[[SERVERS]]
+  HOSTNAME = "h"
+  IPS = ["10.0.0.1"]
+
+[META]
+  [META.SUB]
+    N = 1
+`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.KeyCase = test.c
+		if err := enc.Encode(val); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != test.expected {
+			t.Errorf("KeyCase %d: want\n%s\nbut got\n%s", test.c,
+				test.expected, got)
+		}
+	}
+
+	// Keys are quoted after their case is changed.
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.KeyCase = CaseLower
+	err := enc.Encode(map[string]interface{}{
+		"A/B": 1, "Key": 2, "T:U": map[string]int{"É": 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "\"a/b\" = 1\nkey = 2\n\n[\"t:u\"]\n  \"é\" = 3\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("quoted keys: want %q, got %q", expected, got)
+	}
+
+	// Keys that are only different by case can't both be written.
+	collisions := map[string]interface{}{
+		"fields": struct {
+			A int
+			B int `toml:"a"`
+		}{1, 2},
+		"tables": struct {
+			A struct{ X int }
+			B struct{ Y int } `toml:"a"`
+		}{},
+		"map":        map[string]int{"A": 1, "a": 2},
+		"map tables": map[string]interface{}{"A": 1, "a": map[string]int{}},
+		"inline": struct {
+			T map[string]int `toml:",inline"`
+		}{map[string]int{"A": 1, "a": 2}},
+		"primitive map": map[string]map[string]int{"t": {"X": 1, "x": 2}},
+	}
+	for label, val := range collisions {
+		enc := NewEncoder(ioutil.Discard)
+		enc.KeyCase = CaseLower
+		err := enc.Encode(val)
+		if err == nil ||
+			!strings.HasPrefix(err.Error(), errDuplicateKey.Error()) {
+			t.Errorf("%s: want error %v, got %v", label, errDuplicateKey,
+				err)
+		}
+	}
+}
+
+func benchmarkEncodeMap(b *testing.B, noFastPath bool) {
+	val := make(map[string]int, 10000)
+	for i := 0; i < 10000; i++ {
+		val[fmt.Sprintf("key%d", i)] = i
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.noFastPath = noFastPath
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := enc.Encode(val); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeMapOfInts(b *testing.B) { benchmarkEncodeMap(b, false) }
+
+func BenchmarkEncodeMapOfIntsNoFastPath(b *testing.B) {
+	benchmarkEncodeMap(b, true)
 }
 
 func ExampleEncoder_Encode() {
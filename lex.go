@@ -268,10 +268,30 @@ func lexTableNameStart(lx *lexer) stateFn {
 	case tableSep:
 		return lx.errorf("Unexpected table separator. (Tables cannot " +
 			"be empty.)")
+	case stringStart:
+		// A quoted piece of the name, which is lexed like a string.
+		lx.ignore()
+		lx.push(lexQuotedTableNameEnd)
+		return lexString
 	}
 	return lexTableName
 }
 
+// lexQuotedTableNameEnd consumes the end of a quoted piece of a table name,
+// which must be followed by a table separator or the end of the name.
+func lexQuotedTableNameEnd(lx *lexer) stateFn {
+	switch r := lx.next(); r {
+	case tableSep:
+		lx.ignore()
+		return lexTableNameStart
+	case tableEnd:
+		return lx.pop()
+	default:
+		return lx.errorf("Expected %q or %q after a quoted table name, "+
+			"but got %q instead.", tableSep, tableEnd, r)
+	}
+}
+
 // lexTableName lexes the name of a table. It assumes that at least one
 // valid character for the table has already been read.
 func lexTableName(lx *lexer) stateFn {
@@ -309,10 +329,25 @@ func lexKeyStart(lx *lexer) stateFn {
 
 	lx.ignore()
 	lx.emit(itemKeyStart)
-	lx.next()
+	if lx.next() == stringStart {
+		// A quoted key, which is lexed like a string.
+		lx.ignore()
+		lx.push(lexQuotedKeyEnd)
+		return lexString
+	}
 	return lexKey
 }
 
+// lexQuotedKeyEnd consumes the whitespace after a quoted key, up to the key
+// separator.
+func lexQuotedKeyEnd(lx *lexer) stateFn {
+	if isWhitespace(lx.peek()) {
+		lx.next()
+		return lexSkip(lx, lexQuotedKeyEnd)
+	}
+	return lexKeyEnd
+}
+
 // lexKey consumes the text of a key. Assumes that the first character (which
 // is not whitespace) has already been consumed.
 func lexKey(lx *lexer) stateFn {
@@ -662,7 +697,6 @@ func lexDateAfterYear(lx *lexer) stateFn {
 		'0', '0', '-', '0', '0',
 		'T',
 		'0', '0', ':', '0', '0', ':', '0', '0',
-		'Z',
 	}
 	for _, f := range formats {
 		r := lx.next()
@@ -676,6 +710,21 @@ func lexDateAfterYear(lx *lexer) stateFn {
 				"but found %q instead.", f, r)
 		}
 	}
+	// Fractional seconds are optional.
+	if lx.peek() == '.' {
+		lx.next()
+		if !isDigit(lx.peek()) {
+			return lx.errorf("Expected digit in fractional seconds of "+
+				"ISO8601 datetime, but found %q instead.", lx.peek())
+		}
+		for isDigit(lx.peek()) {
+			lx.next()
+		}
+	}
+	if r := lx.next(); r != 'Z' {
+		return lx.errorf("Expected %q in ISO8601 datetime, "+
+			"but found %q instead.", 'Z', r)
+	}
 	lx.emit(itemDatetime)
 	return lx.pop()
 }
@@ -99,12 +99,12 @@ func (p *parser) topLevel(item item) {
 		p.approxLine = item.line
 		p.expect(itemText)
 	case itemTableStart:
-		kg := p.expect(itemText)
+		kg := p.next()
 		p.approxLine = kg.line
 
 		key := make(Key, 0)
-		for ; kg.typ == itemText; kg = p.next() {
-			key = append(key, kg.val)
+		for ; kg.typ == itemText || kg.typ == itemString; kg = p.next() {
+			key = append(key, p.keyPiece(kg))
 		}
 		p.assertEqual(itemTableEnd, kg.typ)
 
@@ -112,12 +112,12 @@ func (p *parser) topLevel(item item) {
 		p.setType("", tomlHash)
 		p.ordered = append(p.ordered, key)
 	case itemArrayTableStart:
-		kg := p.expect(itemText)
+		kg := p.next()
 		p.approxLine = kg.line
 
 		key := make(Key, 0)
-		for ; kg.typ == itemText; kg = p.next() {
-			key = append(key, kg.val)
+		for ; kg.typ == itemText || kg.typ == itemString; kg = p.next() {
+			key = append(key, p.keyPiece(kg))
 		}
 		p.assertEqual(itemArrayTableEnd, kg.typ)
 
@@ -125,14 +125,17 @@ func (p *parser) topLevel(item item) {
 		p.setType("", tomlArrayHash)
 		p.ordered = append(p.ordered, key)
 	case itemKeyStart:
-		kname := p.expect(itemText)
-		p.currentKey = kname.val
+		kname := p.next()
+		if kname.typ != itemString {
+			p.assertEqual(itemText, kname.typ)
+		}
+		p.currentKey = p.keyPiece(kname)
 		p.approxLine = kname.line
 
 		val, typ := p.value(p.next())
 		p.setValue(p.currentKey, val)
 		p.setType(p.currentKey, typ)
-		p.ordered = append(p.ordered, p.context.add(p.currentKey))
+		p.ordered = append(p.ordered, p.context.Add(p.currentKey))
 
 		p.currentKey = ""
 	default:
@@ -140,6 +143,15 @@ func (p *parser) topLevel(item item) {
 	}
 }
 
+// keyPiece returns a piece of a key: the text of a bare key, or the contents
+// of a quoted key, with its escapes replaced like a string's.
+func (p *parser) keyPiece(it item) string {
+	if it.typ == itemString {
+		return p.replaceUnicode(replaceEscapes(it.val))
+	}
+	return it.val
+}
+
 // value translates an expected value from the lexer into a Go value wrapped
 // as an empty interface.
 func (p *parser) value(it item) (interface{}, tomlType) {
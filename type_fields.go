@@ -9,6 +9,7 @@ package toml
 import (
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 )
 
@@ -20,6 +21,59 @@ type field struct {
 	typ   reflect.Type // the type of the field
 }
 
+// tagOptions is the parsed form of a `toml` struct tag, which consists of
+// an optional key name followed by comma separated options:
+//
+//	Field int `toml:"name,omitempty"`
+type tagOptions struct {
+	skip      bool   // "-"
+	name      string // the key name; empty if not given
+	omitempty bool   // omit false, 0, "", nil and empty collections
+	omitzero  bool   // omit zero values only; keeps empty non-nil collections
+	inline    bool   // write a table as an inline table
+	asString  bool   // write a number or boolean as a string
+}
+
+// getOptions parses the `toml` tag of a struct field. If both omitempty and
+// omitzero are given, the field is omitted when either of them applies.
+func getOptions(tag reflect.StructTag) tagOptions {
+	return parseTag(tag.Get("toml"))
+}
+
+// getEncodeOptions is like getOptions, but if useJSON is set and the field has
+// no `toml` tag, its `json` tag is used instead. The name and the "-",
+// omitempty and string options of json tags have the same meaning in both
+// packages, and other json options are ignored.
+func getEncodeOptions(tag reflect.StructTag, useJSON bool) tagOptions {
+	if useJSON && tag.Get("toml") == "" {
+		return parseTag(tag.Get("json"))
+	}
+	return getOptions(tag)
+}
+
+// parseTag parses a `toml` (or `json`) tag.
+func parseTag(t string) tagOptions {
+	if t == "-" {
+		return tagOptions{skip: true}
+	}
+	var opts tagOptions
+	parts := strings.Split(t, ",")
+	opts.name = parts[0]
+	for _, s := range parts[1:] {
+		switch s {
+		case "omitempty":
+			opts.omitempty = true
+		case "omitzero":
+			opts.omitzero = true
+		case "inline":
+			opts.inline = true
+		case "string":
+			opts.asString = true
+		}
+	}
+	return opts
+}
+
 // byName sorts field by name, breaking ties with depth,
 // then breaking ties with "name came from toml tag", then
 // breaking ties with index sequence.
@@ -95,10 +149,11 @@ func typeFields(t reflect.Type) []field {
 				if sf.PkgPath != "" { // unexported
 					continue
 				}
-				name := sf.Tag.Get("toml")
-				if name == "-" {
+				opts := getOptions(sf.Tag)
+				if opts.skip {
 					continue
 				}
+				name := opts.name
 				index := make([]int, len(f.index)+1)
 				copy(index, f.index)
 				index[len(f.index)] = i